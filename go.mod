@@ -1,3 +1,5 @@
 module github.com/haochen233/proxy
 
-go 1.16
+go 1.18
+
+require golang.org/x/time v0.5.0
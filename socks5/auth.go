@@ -0,0 +1,148 @@
+package socks5
+
+import (
+	"errors"
+	"io"
+	"net"
+)
+
+// PasswordAuthVersion is the version of the username/password
+// subnegotiation defined in RFC 1929.
+const PasswordAuthVersion = 0x01
+
+// status of the username/password subnegotiation
+const (
+	PasswordAuthSucceeded uint8 = 0x00
+	PasswordAuthFailed    uint8 = 0x01
+)
+
+// Authenticator performs the subnegotiation of an authentication method once
+// it has been selected.
+type Authenticator interface {
+	// Method returns the method the authenticator implements.
+	Method() METHOD
+	// Authenticate runs the subnegotiation on conn.
+	Authenticate(conn net.Conn) (*AuthResult, error)
+}
+
+// AuthResult describes a successfully authenticated client.
+type AuthResult struct {
+	// Conn is the connection to use for the rest of the session, which may
+	// wrap the authenticated one when the method encapsulates traffic. If
+	// nil, the authenticated connection is used as is.
+	Conn net.Conn
+	// User is the identity the client authenticated as, if the method has
+	// one.
+	User string
+}
+
+// NoAuthAuthenticator implements NoAuth, which has no subnegotiation.
+type NoAuthAuthenticator struct{}
+
+// Method returns NoAuth.
+func (NoAuthAuthenticator) Method() METHOD {
+	return NoAuth
+}
+
+// Authenticate accepts the client without reading from conn.
+func (NoAuthAuthenticator) Authenticate(conn net.Conn) (*AuthResult, error) {
+	return &AuthResult{}, nil
+}
+
+// UserPassAuthenticator implements the username/password subnegotiation of
+// RFC 1929.
+type UserPassAuthenticator struct {
+	// Credentials validates the username and password sent by the client.
+	Credentials PasswordAuthenticator
+}
+
+// Method returns AuthPassword.
+func (a *UserPassAuthenticator) Method() METHOD {
+	return AuthPassword
+}
+
+// Authenticate performs the subnegotiation as HandlePasswordAuth does.
+func (a *UserPassAuthenticator) Authenticate(conn net.Conn) (*AuthResult, error) {
+	user, err := passwordAuth(conn, a.Credentials)
+	if err != nil {
+		return nil, err
+	}
+	return &AuthResult{User: user}, nil
+}
+
+// PasswordAuthenticator validates the credentials sent by a client during
+// the username/password subnegotiation.
+type PasswordAuthenticator interface {
+	Validate(user, pass string) bool
+}
+
+// StaticCredentials is a PasswordAuthenticator backed by a map of
+// username to password.
+type StaticCredentials map[string]string
+
+// Validate reports whether user exists and pass matches its password.
+func (c StaticCredentials) Validate(user, pass string) bool {
+	password, ok := c[user]
+	return ok && password == pass
+}
+
+// ErrAuthFailed is returned by HandlePasswordAuth when the client sent
+// credentials that were rejected.
+var ErrAuthFailed = errors.New("authentication failed")
+
+// HandlePasswordAuth performs the username/password subnegotiation on conn.
+// On failure the connection is closed as required by RFC 1929.
+//
+//	+----+------+----------+------+----------+
+//	|VER | ULEN |  UNAME   | PLEN |  PASSWD  |
+//	+----+------+----------+------+----------+
+//	| 1  |  1   | 1 to 255 |  1   | 1 to 255 |
+//	+----+------+----------+------+----------+
+func HandlePasswordAuth(conn net.Conn, auth PasswordAuthenticator) error {
+	_, err := passwordAuth(conn, auth)
+	return err
+}
+
+// passwordAuth is HandlePasswordAuth, also returning the username the client
+// authenticated as.
+func passwordAuth(conn net.Conn, auth PasswordAuthenticator) (string, error) {
+	header := make([]byte, 2)
+	_, err := io.ReadFull(conn, header)
+	if err != nil {
+		return "", err
+	}
+	if header[0] != PasswordAuthVersion {
+		return "", errors.New("unsupported auth version")
+	}
+
+	// UNAME followed by PLEN
+	uname := make([]byte, int(header[1])+1)
+	_, err = io.ReadFull(conn, uname)
+	if err != nil {
+		return "", err
+	}
+	user := string(uname[:len(uname)-1])
+
+	passwd := make([]byte, uname[len(uname)-1])
+	_, err = io.ReadFull(conn, passwd)
+	if err != nil {
+		return "", err
+	}
+	pass := string(passwd)
+
+	// RFC 1929 requires UNAME and PASSWD to be 1 to 255 bytes long
+	status := PasswordAuthFailed
+	if auth != nil && user != "" && pass != "" && auth.Validate(user, pass) {
+		status = PasswordAuthSucceeded
+	}
+
+	err = writeAll(conn, []byte{PasswordAuthVersion, status})
+	if err != nil {
+		return "", err
+	}
+	if status != PasswordAuthSucceeded {
+		conn.Close()
+		return "", ErrAuthFailed
+	}
+	return user, nil
+}
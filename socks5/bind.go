@@ -0,0 +1,124 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// PortRange is an inclusive range of ports.
+type PortRange struct {
+	Min, Max uint16
+}
+
+// bindAcceptTimeout bounds how long a BIND waits for the inbound connection.
+const bindAcceptTimeout = 2 * time.Minute
+
+// ErrNoBindPort is returned when no port in Server.BindPortRange can be
+// listened on.
+var ErrNoBindPort = errors.New("no port available in bind port range")
+
+// handleBind listens for the inbound connection the client expects, reports
+// the listening address in a first reply and the connecting peer's address
+// in a second one, then relays data between the client and that peer.
+func (s *Server) handleBind(ctx context.Context, client net.Conn, request *Request, stats *ConnStats) error {
+	host := hostOf(client.LocalAddr())
+	ln, err := s.listenBind(host)
+	if err != nil {
+		sendStatusReply(client, GeneralSOCKSServerFail)
+		return err
+	}
+	defer ln.Close()
+
+	// the listener's own address has the port the system actually chose
+	err = WriteReply(client, boundReply(s.advertisedBindAddr(ln.Addr())))
+	if err != nil {
+		return err
+	}
+
+	if tcpLn, ok := ln.(*net.TCPListener); ok {
+		tcpLn.SetDeadline(time.Now().Add(bindAcceptTimeout))
+	}
+	// stop waiting for the peer if the client hangs up or is closed by
+	// Shutdown
+	stop := watchHangup(client, func() { ln.Close() })
+	peer, err := ln.Accept()
+	stop()
+	if err != nil {
+		stats.Reply = mapErrorToREP(err)
+		sendStatusReply(client, stats.Reply)
+		return err
+	}
+	defer peer.Close()
+	ln.Close()
+
+	if !s.BindAnyPeer && !s.bindPeerMatches(ctx, request, peer.RemoteAddr()) {
+		stats.Reply = ConnNotAllow
+		sendStatusReply(client, ConnNotAllow)
+		return &ReplyError{
+			REP: ConnNotAllow,
+			Err: fmt.Errorf("socks5: BIND peer %s is not the requested %s", peer.RemoteAddr(), requestDest(request)),
+		}
+	}
+
+	stats.Reply = Succeeded
+	err = WriteReply(client, boundReply(peer.RemoteAddr()))
+	if err != nil {
+		return err
+	}
+	return s.relay(ctx, client, peer, stats)
+}
+
+// advertisedBindAddr returns the address to report for a BIND listener bound
+// to local, applying s.AdvertisedBindAddr.
+func (s *Server) advertisedBindAddr(local net.Addr) net.Addr {
+	if s.AdvertisedBindAddr == nil {
+		return local
+	}
+	addr := *s.AdvertisedBindAddr
+	if addr.Port == 0 {
+		_, addr.Port = splitAddr(local)
+	}
+	return &addr
+}
+
+// bindPeerMatches reports whether addr, the peer that connected to a BIND
+// listener, is the host given in request. An unspecified DST.ADDR, which
+// clients send when they do not know the peer, and a domain left unresolved
+// match any peer.
+func (s *Server) bindPeerMatches(ctx context.Context, request *Request, addr net.Addr) bool {
+	if request.Atyp != DOMAINNAME && request.DesTAddr.IsUnspecified() {
+		return true
+	}
+	hosts, err := s.resolve(ctx, request.Atyp, request.DesTAddr, request.Domain)
+	if err != nil {
+		return false
+	}
+	ip, _ := splitAddr(addr)
+	for _, host := range hosts {
+		want := net.ParseIP(host)
+		if want == nil || want.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// listenBind listens on host at a port from s.BindPortRange, or at an
+// ephemeral port if the range is not set.
+func (s *Server) listenBind(host string) (net.Listener, error) {
+	r := s.BindPortRange
+	if r.Min == 0 && r.Max == 0 {
+		return net.Listen("tcp", net.JoinHostPort(host, "0"))
+	}
+	for port := int(r.Min); port <= int(r.Max); port++ {
+		ln, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+		if err == nil {
+			return ln, nil
+		}
+	}
+	return nil, ErrNoBindPort
+}
@@ -0,0 +1,106 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// startBind sends a BIND request on a new connection to the server at addr
+// and returns the connection once the first reply has been read.
+func startBind(t *testing.T, addr string) (*Reply, func()) {
+	t.Helper()
+	conn := dialNoAuth(t, addr)
+	reply := sendRequest(t, conn, BIND, "0.0.0.0:0")
+	if reply.REP != Succeeded {
+		t.Fatalf("first BIND reply REP = %#x, want Succeeded", reply.REP)
+	}
+	return reply, func() { conn.Close() }
+}
+
+func TestBindClientHangup(t *testing.T) {
+	s := &Server{}
+	_, hangup := startBind(t, startServer(t, s))
+	hangup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	err := s.Shutdown(ctx)
+	if err != nil {
+		t.Fatalf("Shutdown: %v, want the BIND to end with its client", err)
+	}
+}
+
+func TestBindShutdown(t *testing.T) {
+	s := &Server{}
+	startBind(t, startServer(t, s))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := s.Shutdown(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Shutdown: %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Shutdown took %v, want the pending BIND closed at the deadline", elapsed)
+	}
+}
+
+func TestBindPortRange(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	taken := uint16(ln.Addr().(*net.TCPAddr).Port)
+
+	conn := dialNoAuth(t, startServer(t, &Server{BindPortRange: PortRange{taken, taken}}))
+	reply := sendRequest(t, conn, BIND, "0.0.0.0:0")
+	if reply.REP != GeneralSOCKSServerFail {
+		t.Errorf("REP = %#x, want GeneralSOCKSServerFail with every port in range taken", reply.REP)
+	}
+
+	ln.Close()
+	conn = dialNoAuth(t, startServer(t, &Server{BindPortRange: PortRange{taken, taken}}))
+	reply = sendRequest(t, conn, BIND, "0.0.0.0:0")
+	if reply.REP != Succeeded || reply.BNDPort != taken {
+		t.Errorf("reply = %#x port %d, want Succeeded on port %d", reply.REP, reply.BNDPort, taken)
+	}
+}
+
+func TestBindReplyPort(t *testing.T) {
+	advertised := &net.TCPAddr{IP: net.IPv4(203, 0, 113, 7)}
+	for _, s := range []*Server{{}, {AdvertisedBindAddr: advertised}} {
+		conn := dialNoAuth(t, startServer(t, s))
+		first := sendRequest(t, conn, BIND, "0.0.0.0:0")
+		if first.REP != Succeeded || first.BNDPort == 0 {
+			t.Fatalf("first reply = %#x port %d, want Succeeded on the port chosen for :0", first.REP, first.BNDPort)
+		}
+		wantIP := net.IPv4(127, 0, 0, 1)
+		if s.AdvertisedBindAddr != nil {
+			wantIP = advertised.IP
+		}
+		if !first.BNDAddr.Equal(wantIP) {
+			t.Errorf("first reply BND.ADDR = %v, want %v", first.BNDAddr, wantIP)
+		}
+
+		// the reported port is the one the server really listens on
+		peer, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(first.BNDPort))))
+		if err != nil {
+			t.Fatalf("connecting to the reported port: %v", err)
+		}
+		defer peer.Close()
+		second, err := ReadReply(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		local := peer.LocalAddr().(*net.TCPAddr)
+		if second.REP != Succeeded || !second.BNDAddr.Equal(local.IP) || int(second.BNDPort) != local.Port {
+			t.Errorf("second reply = %#x %v:%d, want Succeeded from %v", second.REP, second.BNDAddr, second.BNDPort, local)
+		}
+	}
+}
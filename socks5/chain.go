@@ -0,0 +1,177 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// ChainDialer is a Dialer that connects to destinations through an upstream
+// socks5 server. Set it as Server.Dialer to forward every CONNECT to the
+// next hop:
+//
+//	s := socks5.NewServer(socks5.WithDialer(socks5.NewChainDialer("upstream:1080", "user", "pass")))
+//
+// When the upstream server refuses a request, the error returned carries
+// its REP as a *ReplyError, so the downstream client is replied the same
+// REP.
+//
+// A socks5 connection carries a single CONNECT, so connections are never
+// reused once a request has been sent on them. With Idle set, the dialer
+// instead keeps that many connections open that have already been
+// negotiated and authenticated, so only the request itself waits on the
+// upstream's round trip. This is safe as long as the upstream lets
+// connections sit between authentication and request; one that closes them
+// earlier (its handshake timeout) only costs a retry on a fresh connection,
+// and IdleTimeout can be set below that timeout to avoid it.
+type ChainDialer struct {
+	Client
+	// Idle is the number of ready connections to keep. Zero disables the
+	// pool.
+	Idle int
+	// IdleTimeout discards ready connections that have waited this long.
+	// Zero keeps them until used.
+	IdleTimeout time.Duration
+
+	mu      sync.Mutex
+	ready   []readyConn
+	filling bool
+	closed  bool
+}
+
+// readyConn is a connection opened by Client.open, waiting for a request.
+type readyConn struct {
+	net.Conn
+	since time.Time
+}
+
+// NewChainDialer returns a ChainDialer for the upstream server at addr.
+// Username and password are only sent if username is not empty.
+func NewChainDialer(addr, username, password string) *ChainDialer {
+	return &ChainDialer{Client: Client{
+		Addr:     addr,
+		Username: username,
+		Password: password,
+	}}
+}
+
+// Dial connects to addr through the upstream server.
+func (d *ChainDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext connects to addr through the upstream server using ctx,
+// sending the request on a ready connection when one is available.
+func (d *ChainDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if d.Idle <= 0 {
+		return d.Client.DialContext(ctx, network, addr)
+	}
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, errors.New("socks5: network not supported: " + network)
+	}
+	request, err := NewRequestFromAddr(V5, CONNECT, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	defer d.fill()
+	conn := d.take()
+	if conn == nil {
+		return d.Client.DialContext(ctx, network, addr)
+	}
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+
+	err = d.connect(ctx, conn, request)
+	if err == nil {
+		return conn, nil
+	}
+	conn.Close()
+	var replyErr *ReplyError
+	if errors.As(err, &replyErr) || ctx.Err() != nil {
+		return nil, err
+	}
+	// the upstream dropped the waiting connection, try a fresh one
+	return d.Client.DialContext(ctx, network, addr)
+}
+
+// Close closes the ready connections and stops the dialer from opening new
+// ones.
+func (d *ChainDialer) Close() error {
+	d.mu.Lock()
+	ready := d.ready
+	d.ready = nil
+	d.closed = true
+	d.mu.Unlock()
+
+	for _, rc := range ready {
+		rc.Close()
+	}
+	return nil
+}
+
+// take returns a ready connection, or nil if there is none.
+func (d *ChainDialer) take() net.Conn {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for len(d.ready) > 0 {
+		rc := d.ready[0]
+		d.ready = d.ready[1:]
+		if d.IdleTimeout > 0 && time.Since(rc.since) > d.IdleTimeout {
+			rc.Close()
+			continue
+		}
+		return rc.Conn
+	}
+	return nil
+}
+
+// fill opens ready connections in the background until Idle of them wait.
+func (d *ChainDialer) fill() {
+	d.mu.Lock()
+	if d.filling || d.closed {
+		d.mu.Unlock()
+		return
+	}
+	d.filling = true
+	d.mu.Unlock()
+
+	go func() {
+		for {
+			d.mu.Lock()
+			if d.closed || len(d.ready) >= d.Idle {
+				d.filling = false
+				d.mu.Unlock()
+				return
+			}
+			d.mu.Unlock()
+
+			ctx := context.Background()
+			var cancel context.CancelFunc = func() {}
+			if d.Timeout > 0 {
+				ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+			}
+			conn, err := d.open(ctx)
+			cancel()
+
+			d.mu.Lock()
+			if err != nil || d.closed {
+				d.filling = false
+				d.mu.Unlock()
+				if conn != nil {
+					conn.Close()
+				}
+				return
+			}
+			d.ready = append(d.ready, readyConn{Conn: conn, since: time.Now()})
+			d.mu.Unlock()
+		}
+	}()
+}
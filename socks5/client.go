@@ -1 +1,213 @@
 package socks5
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// Client dials destinations through a socks5 server. Its Dial and
+// DialContext methods satisfy golang.org/x/net/proxy's Dialer and
+// ContextDialer, so a Client can be plugged into an http.Transport.
+type Client struct {
+	// Addr is the address of the socks5 server.
+	Addr string
+	// Username and Password enable username/password authentication when
+	// Username is not empty.
+	Username string
+	Password string
+	// Timeout bounds connecting to the server plus the whole handshake.
+	// Zero means no timeout.
+	Timeout time.Duration
+	// Strict rejects replies whose RSV field is not 0x00.
+	Strict bool
+	// TLSConfig, if set, makes the client reach the server over TLS, as
+	// served by Server.ListenTLS.
+	TLSConfig *tls.Config
+	// Forward, if set, is used to connect to the server, e.g. another
+	// Client to chain several proxies. If nil, a zero net.Dialer is used.
+	Forward Dialer
+}
+
+// Dial connects to addr through the socks5 server.
+func (c *Client) Dial(network, addr string) (net.Conn, error) {
+	return c.DialContext(context.Background(), network, addr)
+}
+
+// DialContext connects to addr through the socks5 server using ctx.
+func (c *Client) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, errors.New("socks5: network not supported: " + network)
+	}
+
+	request, err := NewRequestFromAddr(V5, CONNECT, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+
+	conn, err := c.open(ctx)
+	if err != nil {
+		return nil, err
+	}
+	err = c.connect(ctx, conn, request)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// open connects to the server and completes method negotiation and
+// authentication, leaving the connection ready for a request.
+func (c *Client) open(ctx context.Context) (net.Conn, error) {
+	var forward Dialer = &net.Dialer{}
+	if c.Forward != nil {
+		forward = c.Forward
+	}
+	conn, err := forward.DialContext(ctx, "tcp", c.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if c.TLSConfig != nil {
+		conn, err = c.clientTLS(conn)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = c.greet(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// connect sends request over conn, opened by open, and reads the reply.
+func (c *Client) connect(ctx context.Context, conn net.Conn, request *Request) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	err := WriteRequest(conn, request)
+	if err != nil {
+		return err
+	}
+
+	reply, err := ReadReply(conn)
+	if err != nil {
+		return err
+	}
+	if c.Strict && reply.RSV != 0x00 {
+		return ErrInvalidRSV
+	}
+	if reply.REP != Succeeded {
+		return &ReplyError{REP: reply.REP}
+	}
+	conn.SetDeadline(time.Time{})
+	return nil
+}
+
+// clientTLS performs the TLS handshake with the server on conn.
+func (c *Client) clientTLS(conn net.Conn) (net.Conn, error) {
+	config := c.TLSConfig
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(c.Addr)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		config = config.Clone()
+		config.ServerName = host
+	}
+
+	tlsConn := tls.Client(conn, config)
+	err := tlsConn.Handshake()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// greet negotiates a method and authenticates over conn.
+func (c *Client) greet(conn net.Conn) error {
+	greeting := []byte{V5, 1, NoAuth}
+	if c.Username != "" {
+		greeting = []byte{V5, 2, NoAuth, AuthPassword}
+	}
+	err := writeAll(conn, greeting)
+	if err != nil {
+		return err
+	}
+
+	selection := make([]byte, 2)
+	_, err = io.ReadFull(conn, selection)
+	if err != nil {
+		return err
+	}
+	if selection[0] != V5 {
+		return errors.New("socks5: unexpected server version")
+	}
+
+	switch selection[1] {
+	case NoAuth:
+	case AuthPassword:
+		if c.Username == "" {
+			return errors.New("socks5: server selected an unoffered method")
+		}
+		err = c.authenticate(conn)
+		if err != nil {
+			return err
+		}
+	case AuthNoMatchedMethod:
+		return ErrNoAcceptableMethods
+	default:
+		return errors.New("socks5: server selected an unoffered method")
+	}
+	return nil
+}
+
+// authenticate performs the client side of the username/password
+// subnegotiation.
+func (c *Client) authenticate(conn net.Conn) error {
+	if len(c.Username) > 255 || len(c.Password) > 255 {
+		return errors.New("socks5: username or password too long")
+	}
+	content := make([]byte, 0, 3+len(c.Username)+len(c.Password))
+	content = append(content, PasswordAuthVersion, byte(len(c.Username)))
+	content = append(content, c.Username...)
+	content = append(content, byte(len(c.Password)))
+	content = append(content, c.Password...)
+	err := writeAll(conn, content)
+	if err != nil {
+		return err
+	}
+
+	status := make([]byte, 2)
+	_, err = io.ReadFull(conn, status)
+	if err != nil {
+		return err
+	}
+	if status[0] != PasswordAuthVersion {
+		return errors.New("socks5: unexpected auth version")
+	}
+	if status[1] != PasswordAuthSucceeded {
+		return ErrAuthFailed
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package socks5
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestClientAuthenticateStatus(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  []byte
+		wantErr error
+	}{
+		{"succeeded", []byte{PasswordAuthVersion, PasswordAuthSucceeded}, nil},
+		{"failed", []byte{PasswordAuthVersion, PasswordAuthFailed}, ErrAuthFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := authenticateAgainst(t, tt.status)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("authenticate: %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	// a status that is not an RFC 1929 reply, e.g. a method selection
+	err := authenticateAgainst(t, []byte{V5, PasswordAuthSucceeded})
+	if err == nil || errors.Is(err, ErrAuthFailed) {
+		t.Errorf("authenticate with version %#x: %v, want a version error", V5, err)
+	}
+}
+
+// authenticateAgainst runs the client side of the username/password
+// subnegotiation against a server that answers with status.
+func authenticateAgainst(t *testing.T, status []byte) error {
+	t.Helper()
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		defer server.Close()
+		// VER ULEN "user" PLEN "secret"
+		io.ReadFull(server, make([]byte, 1+1+4+1+6))
+		server.Write(status)
+	}()
+	c := &Client{Username: "user", Password: "secret"}
+	return c.authenticate(client)
+}
@@ -0,0 +1,99 @@
+package socks5
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+)
+
+// ErrRequestTooLarge is returned when a client sends more than
+// Server.MaxRequestBytes before its request has been read.
+var ErrRequestTooLarge = errors.New("request is too large")
+
+// bufferedConn is a net.Conn whose reads go through a bufio.Reader, so the
+// server can peek at the first bytes without losing them. It can also cap
+// the number of bytes read, which bounds the handshake phase.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+
+	limited   bool
+	remaining int
+
+	// unanswered, when set, answers the request just read with a failure.
+	// The first write, which carries the reply, clears it.
+	unanswered func()
+}
+
+func newBufferedConn(conn net.Conn) *bufferedConn {
+	return &bufferedConn{Conn: conn, r: bufio.NewReader(conn)}
+}
+
+// SetReadLimit makes reads fail with ErrRequestTooLarge once n more bytes
+// have been read. A non-positive n removes the limit.
+func (c *bufferedConn) SetReadLimit(n int) {
+	c.limited = n > 0
+	c.remaining = n
+}
+
+// awaitReply records that a request has been read, which fail answers if
+// the server ends up not replying to it.
+func (c *bufferedConn) awaitReply(fail func()) {
+	c.unanswered = fail
+}
+
+// answerPending sends the failure reply of a request left unanswered, if
+// any.
+func (c *bufferedConn) answerPending() {
+	if fail := c.unanswered; fail != nil {
+		fail()
+	}
+}
+
+func (c *bufferedConn) Write(b []byte) (int, error) {
+	if c.unanswered != nil {
+		c.unanswered = nil
+	}
+	return c.Conn.Write(b)
+}
+
+// Peek returns the next n bytes without advancing the reader.
+func (c *bufferedConn) Peek(n int) ([]byte, error) {
+	return c.r.Peek(n)
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	if !c.limited {
+		return c.r.Read(b)
+	}
+	if c.remaining == 0 {
+		return 0, ErrRequestTooLarge
+	}
+	if len(b) > c.remaining {
+		b = b[:c.remaining]
+	}
+	n, err := c.r.Read(b)
+	c.remaining -= n
+	return n, err
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+// writeAll writes all of b to w, retrying short writes that w reports
+// without an error.
+func writeAll(w io.Writer, b []byte) error {
+	for len(b) > 0 {
+		n, err := w.Write(b)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return io.ErrShortWrite
+		}
+		b = b[n:]
+	}
+	return nil
+}
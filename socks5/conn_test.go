@@ -0,0 +1,46 @@
+package socks5
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+// shortWriteConn is a fakeConn accepting at most max bytes per Write.
+type shortWriteConn struct {
+	*fakeConn
+	max    int
+	writes int
+}
+
+func (c *shortWriteConn) Write(b []byte) (int, error) {
+	c.writes++
+	if len(b) > c.max {
+		b = b[:c.max]
+	}
+	return c.fakeConn.Write(b)
+}
+
+func TestWriteReplyShortWrites(t *testing.T) {
+	conn := &shortWriteConn{fakeConn: newFakeConn(), max: 3}
+	reply := NewReply(V5)
+	reply.REP = Succeeded
+	reply.Atyp = IPV6
+	reply.BNDAddr = net.IPv6loopback
+	reply.BNDPort = 1080
+
+	err := WriteReply(conn, reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := SerializeReply(*reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(conn.out.Bytes(), want) {
+		t.Errorf("client read %v, want %v", conn.out.Bytes(), want)
+	}
+	if conn.writes < len(want)/conn.max {
+		t.Errorf("reply sent in %d writes, want short writes retried", conn.writes)
+	}
+}
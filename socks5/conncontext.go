@@ -0,0 +1,47 @@
+package socks5
+
+import (
+	"context"
+	"net"
+)
+
+// ConnContext identifies the client connection a request was received on,
+// so hooks can attribute requests to clients. Router and OnRequest receive
+// it directly; Rules, the Resolver and the Dialer can get it from their
+// context with ConnContextFromContext.
+type ConnContext struct {
+	// ClientAddr is the client's remote address.
+	ClientAddr net.Addr
+	// Method is the authentication method negotiated with the client. It is
+	// NoAuth for SOCKS4 clients.
+	Method METHOD
+	// AuthUser is the username the client authenticated with, if it used
+	// username/password authentication.
+	AuthUser string
+	// Command is the command the client requested, once its request has
+	// been read.
+	Command CMD
+}
+
+type connContextKey struct{}
+
+// ConnContextFromContext returns the ConnContext stored in ctx by the server
+// serving the connection, if any.
+func ConnContextFromContext(ctx context.Context) (*ConnContext, bool) {
+	cc, ok := ctx.Value(connContextKey{}).(*ConnContext)
+	return cc, ok
+}
+
+// withConnContext returns a copy of ctx carrying cc.
+func withConnContext(ctx context.Context, cc *ConnContext) context.Context {
+	return context.WithValue(ctx, connContextKey{}, cc)
+}
+
+// connContext returns the ConnContext of ctx, or an empty one if ctx has
+// none.
+func connContext(ctx context.Context) *ConnContext {
+	if cc, ok := ConnContextFromContext(ctx); ok {
+		return cc
+	}
+	return &ConnContext{}
+}
@@ -0,0 +1,84 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"syscall"
+)
+
+// ReplyError is an error that carries the REP code to send to the client.
+type ReplyError struct {
+	REP
+	Err error
+}
+
+func (e *ReplyError) Error() string {
+	if e.Err == nil {
+		return "socks5: reply " + repText(e.REP)
+	}
+	return "socks5: reply " + repText(e.REP) + ": " + e.Err.Error()
+}
+
+func (e *ReplyError) Unwrap() error {
+	return e.Err
+}
+
+// repText returns a description of rep.
+func repText(rep REP) string {
+	switch rep {
+	case Succeeded:
+		return "succeeded"
+	case GeneralSOCKSServerFail:
+		return "general SOCKS server failure"
+	case ConnNotAllow:
+		return "connection not allowed by ruleset"
+	case NetworkUnreachable:
+		return "network unreachable"
+	case HostUnreachable:
+		return "host unreachable"
+	case ConnectionRefused:
+		return "connection refused"
+	case TTLExpired:
+		return "TTL expired"
+	case CMDNotSupported:
+		return "command not supported"
+	case ATYPENotSupported:
+		return "address type not supported"
+	default:
+		return "unknown reply"
+	}
+}
+
+// mapErrorToREP chooses the REP reported to the client for an error that
+// occurred while serving its request.
+func mapErrorToREP(err error) REP {
+	var replyErr *ReplyError
+	if errors.As(err, &replyErr) {
+		return replyErr.REP
+	}
+
+	var dnsErr *net.DNSError
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded):
+		return TTLExpired
+	case errors.As(err, &dnsErr):
+		if dnsErr.IsTimeout {
+			return TTLExpired
+		}
+		return HostUnreachable
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ConnectionRefused
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return HostUnreachable
+	case errors.Is(err, syscall.ENETUNREACH):
+		return NetworkUnreachable
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Timeout() {
+		return TTLExpired
+	}
+	return GeneralSOCKSServerFail
+}
@@ -0,0 +1,52 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestMapErrorToREP(t *testing.T) {
+	tests := []struct {
+		err  error
+		want REP
+	}{
+		{&ReplyError{REP: ConnNotAllow}, ConnNotAllow},
+		{fmt.Errorf("wrapped: %w", &ReplyError{REP: NetworkUnreachable}), NetworkUnreachable},
+		{context.DeadlineExceeded, TTLExpired},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: os.ErrDeadlineExceeded}, TTLExpired},
+		{&net.DNSError{Err: "i/o timeout", Name: "example.com", IsTimeout: true}, TTLExpired},
+		{&net.DNSError{Err: "no such host", Name: "example.com", IsNotFound: true}, HostUnreachable},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, ConnectionRefused},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.EHOSTUNREACH)}, HostUnreachable},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ENETUNREACH)}, NetworkUnreachable},
+		{errors.New("something else"), GeneralSOCKSServerFail},
+	}
+	for _, tt := range tests {
+		if got := mapErrorToREP(tt.err); got != tt.want {
+			t.Errorf("mapErrorToREP(%v) = %#x, want %#x", tt.err, got, tt.want)
+		}
+	}
+}
+
+// hangingDialer never connects, failing only once ctx is done.
+type hangingDialer struct{}
+
+func (hangingDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestDialTimeoutReply(t *testing.T) {
+	s := &Server{Dialer: hangingDialer{}, DialTimeout: 50 * time.Millisecond}
+	conn := dialNoAuth(t, startServer(t, s))
+	reply := sendRequest(t, conn, CONNECT, "192.0.2.1:80")
+	if reply.REP != TTLExpired {
+		t.Errorf("REP = %#x, want TTLExpired (%#x)", reply.REP, TTLExpired)
+	}
+}
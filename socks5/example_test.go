@@ -0,0 +1,61 @@
+package socks5_test
+
+import (
+	"crypto/tls"
+	"io"
+	"log"
+
+	"github.com/haochen233/proxy/socks5"
+)
+
+func ExampleServer_ListenTLS() {
+	cert, err := tls.LoadX509KeyPair("proxy.crt", "proxy.key")
+	if err != nil {
+		log.Fatal(err)
+	}
+	s := &socks5.Server{Addr: "127.0.0.1:1080"}
+	err = s.ListenTLS(&tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		log.Fatal(err)
+	}
+	go s.Accept()
+	defer s.Close()
+
+	// the client speaks plain SOCKS5 inside the TLS session
+	conn, err := tls.Dial("tcp", "127.0.0.1:1080", &tls.Config{ServerName: "proxy.example.com"})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte{socks5.V5, 1, socks5.NoAuth})
+	if err != nil {
+		log.Fatal(err)
+	}
+	selection := make([]byte, 2)
+	_, err = io.ReadFull(conn, selection)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	request, err := socks5.NewRequestFromAddr(socks5.V5, socks5.CONNECT, "example.com:80")
+	if err != nil {
+		log.Fatal(err)
+	}
+	b, err := socks5.SerializeRequest(*request)
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = conn.Write(b)
+	if err != nil {
+		log.Fatal(err)
+	}
+	reply, err := socks5.ReadReply(conn)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if reply.REP != socks5.Succeeded {
+		log.Fatalf("proxy replied %#x", reply.REP)
+	}
+	// conn now carries the connection to example.com:80
+}
@@ -0,0 +1,224 @@
+package socks5
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+)
+
+// GSSAPIVersion is the version of the GSS-API subnegotiation messages
+// defined in RFC 1961.
+const GSSAPIVersion = 0x01
+
+// MTYP values of GSS-API subnegotiation messages
+const (
+	GSSAPIAuthentication uint8 = 0x01
+	GSSAPIProtection     uint8 = 0x02
+	GSSAPIEncapsulation  uint8 = 0x03
+	GSSAPIAbort          uint8 = 0xff
+)
+
+// GSS-API message protection levels
+const (
+	GSSAPIProtectionNone      uint8 = 0x00
+	GSSAPIIntegrity           uint8 = 0x01
+	GSSAPIConfidentiality     uint8 = 0x02
+	GSSAPISelectiveProtection uint8 = 0x03
+)
+
+// GSSAPIContext is a server-side GSS-API security context, typically backed
+// by a Kerberos library.
+type GSSAPIContext interface {
+	// Accept processes a token sent by the client, as gss_accept_sec_context
+	// does. It returns the token to send back, if any, and whether the
+	// context is now established.
+	Accept(token []byte) (out []byte, established bool, err error)
+	// Wrap and Unwrap protect and unprotect a message at the given
+	// protection level, as gss_wrap and gss_unwrap do.
+	Wrap(level uint8, msg []byte) ([]byte, error)
+	Unwrap(level uint8, token []byte) ([]byte, error)
+}
+
+// GSSAPIAuthenticator implements the GSS-API subnegotiation of RFC 1961 on
+// top of a user supplied GSS-API implementation.
+type GSSAPIAuthenticator struct {
+	// NewContext returns a fresh security context for each client.
+	NewContext func() (GSSAPIContext, error)
+	// SelectProtection chooses the protection level given the one the
+	// client asked for. If nil, the client's choice is accepted.
+	SelectProtection func(requested uint8) uint8
+}
+
+// ErrGSSAPIAborted is returned when the client aborts the GSS-API
+// subnegotiation.
+var ErrGSSAPIAborted = errors.New("gssapi subnegotiation aborted")
+
+// Method returns AuthGSSAPI.
+func (a *GSSAPIAuthenticator) Method() METHOD {
+	return AuthGSSAPI
+}
+
+// Authenticate establishes a security context with the client, negotiates
+// the message protection level and returns a connection that encapsulates
+// traffic at that level.
+func (a *GSSAPIAuthenticator) Authenticate(conn net.Conn) (*AuthResult, error) {
+	conn, err := a.authenticate(conn)
+	if err != nil {
+		return nil, err
+	}
+	return &AuthResult{Conn: conn}, nil
+}
+
+func (a *GSSAPIAuthenticator) authenticate(conn net.Conn) (net.Conn, error) {
+	if a.NewContext == nil {
+		return nil, errors.New("gssapi context is not configured")
+	}
+	ctx, err := a.NewContext()
+	if err != nil {
+		writeGSSAPIMessage(conn, GSSAPIAbort, nil)
+		return nil, err
+	}
+
+	//1. context establishment
+	for established := false; !established; {
+		token, err := readGSSAPIMessage(conn, GSSAPIAuthentication)
+		if err != nil {
+			return nil, err
+		}
+		var out []byte
+		out, established, err = ctx.Accept(token)
+		if err != nil {
+			writeGSSAPIMessage(conn, GSSAPIAbort, nil)
+			return nil, err
+		}
+		if len(out) > 0 {
+			err = writeGSSAPIMessage(conn, GSSAPIAuthentication, out)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	//2. protection level negotiation
+	token, err := readGSSAPIMessage(conn, GSSAPIProtection)
+	if err != nil {
+		return nil, err
+	}
+	requested, err := ctx.Unwrap(GSSAPIIntegrity, token)
+	if err != nil {
+		return nil, err
+	}
+	if len(requested) != 1 {
+		return nil, errors.New("invalid gssapi protection level")
+	}
+	level := requested[0]
+	if a.SelectProtection != nil {
+		level = a.SelectProtection(level)
+	}
+	token, err = ctx.Wrap(GSSAPIIntegrity, []byte{level})
+	if err != nil {
+		return nil, err
+	}
+	err = writeGSSAPIMessage(conn, GSSAPIProtection, token)
+	if err != nil {
+		return nil, err
+	}
+
+	if level == GSSAPIProtectionNone {
+		return conn, nil
+	}
+	return &gssapiConn{Conn: conn, ctx: ctx, level: level}, nil
+}
+
+// readGSSAPIMessage reads one subnegotiation message of type mtyp.
+//
+//	+-----+------+-----+----------+
+//	| VER | MTYP | LEN |  TOKEN   |
+//	+-----+------+-----+----------+
+//	|  1  |  1   |  2  | Variable |
+//	+-----+------+-----+----------+
+func readGSSAPIMessage(r io.Reader, mtyp uint8) ([]byte, error) {
+	header := make([]byte, 4)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, err
+	}
+	if header[0] != GSSAPIVersion {
+		return nil, errors.New("unsupported gssapi version")
+	}
+	if header[1] == GSSAPIAbort {
+		return nil, ErrGSSAPIAborted
+	}
+	if header[1] != mtyp {
+		return nil, errors.New("unexpected gssapi message type")
+	}
+
+	token := make([]byte, binary.BigEndian.Uint16(header[2:]))
+	_, err = io.ReadFull(r, token)
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// writeGSSAPIMessage writes one subnegotiation message of type mtyp.
+func writeGSSAPIMessage(w io.Writer, mtyp uint8, token []byte) error {
+	if len(token) > 0xffff {
+		return errors.New("gssapi token is too long")
+	}
+	msg := make([]byte, 4, 4+len(token))
+	msg[0] = GSSAPIVersion
+	msg[1] = mtyp
+	binary.BigEndian.PutUint16(msg[2:], uint16(len(token)))
+	return writeAll(w, append(msg, token...))
+}
+
+// gssapiMaxChunk bounds the plaintext wrapped into a single message, leaving
+// room for the per-message overhead added by Wrap.
+const gssapiMaxChunk = 0xffff - 1024
+
+// gssapiConn encapsulates all traffic in GSS-API protected messages.
+type gssapiConn struct {
+	net.Conn
+	ctx   GSSAPIContext
+	level uint8
+	buf   []byte
+}
+
+func (c *gssapiConn) Read(b []byte) (int, error) {
+	for len(c.buf) == 0 {
+		token, err := readGSSAPIMessage(c.Conn, GSSAPIEncapsulation)
+		if err != nil {
+			return 0, err
+		}
+		c.buf, err = c.ctx.Unwrap(c.level, token)
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+func (c *gssapiConn) Write(b []byte) (int, error) {
+	var written int
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > gssapiMaxChunk {
+			chunk = chunk[:gssapiMaxChunk]
+		}
+		token, err := c.ctx.Wrap(c.level, chunk)
+		if err != nil {
+			return written, err
+		}
+		err = writeGSSAPIMessage(c.Conn, GSSAPIEncapsulation, token)
+		if err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		b = b[len(chunk):]
+	}
+	return written, nil
+}
@@ -0,0 +1,39 @@
+package socks5
+
+import "strconv"
+
+// Logger receives the server's log output. A *log.Logger satisfies it.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// logf logs through s.Logger, discarding the output when it is nil.
+func (s *Server) logf(format string, v ...interface{}) {
+	if s.Logger != nil {
+		s.Logger.Printf(format, v...)
+	}
+}
+
+// logAccess writes the access line of a connection that made a request to
+// s.AccessLog, as space-separated key=value pairs.
+func (s *Server) logAccess(stats *ConnStats) {
+	if s.AccessLog == nil || stats.Command == 0 {
+		return
+	}
+	s.AccessLog.Printf("socks5: client=%s user=%q cmd=%s dest=%s rep=%d up=%d down=%d duration=%s",
+		stats.Client, stats.AuthUser, cmdText(stats.Command), stats.Destination,
+		stats.Reply, stats.BytesUp, stats.BytesDown, stats.Duration)
+}
+
+// cmdText returns the name of cmd.
+func cmdText(cmd CMD) string {
+	switch cmd {
+	case CONNECT:
+		return "connect"
+	case BIND:
+		return "bind"
+	case UDPASSOCIATE:
+		return "udp-associate"
+	}
+	return strconv.Itoa(int(cmd))
+}
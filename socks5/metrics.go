@@ -0,0 +1,69 @@
+package socks5
+
+import "sync/atomic"
+
+// Metrics receives events from a Server, e.g. to export them as Prometheus
+// counters. Implementations must be safe for concurrent use.
+type Metrics interface {
+	// OnConnection is called for every accepted client connection.
+	OnConnection()
+	// OnAuthFailure is called when a client fails to authenticate.
+	OnAuthFailure()
+	// OnCommand is called for every request read from a client.
+	OnCommand(cmd CMD)
+	// OnBytesRelayed is called with the number of bytes relayed: for a
+	// CONNECT or BIND relay once it ends, counting both directions, and for
+	// a UDP association with every datagram relayed.
+	OnBytesRelayed(n int64)
+	// OnDialError is called with the REP sent to the client when dialing
+	// its destination fails.
+	OnDialError(rep REP)
+}
+
+// noopMetrics is the Metrics used when Server.Metrics is nil.
+type noopMetrics struct{}
+
+func (noopMetrics) OnConnection()          {}
+func (noopMetrics) OnAuthFailure()         {}
+func (noopMetrics) OnCommand(CMD)          {}
+func (noopMetrics) OnBytesRelayed(n int64) {}
+func (noopMetrics) OnDialError(REP)        {}
+
+// Counters is a Metrics that counts events with atomic counters. Read the
+// fields with the sync/atomic Load functions.
+type Counters struct {
+	Connections  int64
+	AuthFailures int64
+	BytesRelayed int64
+	// Commands and DialErrors are indexed by CMD and REP respectively.
+	Commands   [256]int64
+	DialErrors [256]int64
+}
+
+func (c *Counters) OnConnection() {
+	atomic.AddInt64(&c.Connections, 1)
+}
+
+func (c *Counters) OnAuthFailure() {
+	atomic.AddInt64(&c.AuthFailures, 1)
+}
+
+func (c *Counters) OnCommand(cmd CMD) {
+	atomic.AddInt64(&c.Commands[cmd], 1)
+}
+
+func (c *Counters) OnBytesRelayed(n int64) {
+	atomic.AddInt64(&c.BytesRelayed, n)
+}
+
+func (c *Counters) OnDialError(rep REP) {
+	atomic.AddInt64(&c.DialErrors[rep], 1)
+}
+
+// metrics returns s.Metrics, or a no-op Metrics if it is nil.
+func (s *Server) metrics() Metrics {
+	if s.Metrics == nil {
+		return noopMetrics{}
+	}
+	return s.Metrics
+}
@@ -0,0 +1,74 @@
+package socks5
+
+import "time"
+
+// Option configures a Server created by NewServer.
+type Option func(*Server)
+
+// NewServer returns a Server configured by opts. It is the preferred way to
+// create a Server; setting the exported fields of a Server literal directly
+// is equivalent but must be done before Listen is called.
+func NewServer(opts ...Option) *Server {
+	s := &Server{}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// WithListenAddr sets the address the server listens on.
+func WithListenAddr(addr string) Option {
+	return func(s *Server) {
+		s.Addr = addr
+	}
+}
+
+// WithCredentials enables username/password authentication.
+func WithCredentials(auth PasswordAuthenticator) Option {
+	return func(s *Server) {
+		s.Credentials = auth
+	}
+}
+
+// WithAuthenticators sets the authentication methods the server accepts, in
+// its order of preference.
+func WithAuthenticators(auths ...Authenticator) Option {
+	return func(s *Server) {
+		s.Authenticators = auths
+	}
+}
+
+// WithDialer sets the Dialer used to connect to destinations.
+func WithDialer(dialer Dialer) Option {
+	return func(s *Server) {
+		s.Dialer = dialer
+	}
+}
+
+// WithResolver sets the Resolver used for DOMAINNAME destinations.
+func WithResolver(resolver Resolver) Option {
+	return func(s *Server) {
+		s.Resolver = resolver
+	}
+}
+
+// WithDialTimeout sets the timeout for resolving and dialing destinations.
+func WithDialTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.DialTimeout = d
+	}
+}
+
+// WithIdleTimeout sets the idle timeout of relayed connections.
+func WithIdleTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.IdleTimeout = d
+	}
+}
+
+// WithMaxConnections caps the number of connections served at once.
+func WithMaxConnections(n int) Option {
+	return func(s *Server) {
+		s.MaxConnections = n
+	}
+}
@@ -0,0 +1,36 @@
+package socks5
+
+import "sync"
+
+// defaultBufferSize is the size of relay buffers when Server.BufferSize is
+// not set.
+const defaultBufferSize = 32 * 1024
+
+// bufferPool is a pool of byte slices of a fixed size.
+type bufferPool struct {
+	size int
+	pool sync.Pool
+}
+
+func newBufferPool(size int) *bufferPool {
+	p := &bufferPool{size: size}
+	p.pool.New = func() interface{} {
+		buf := make([]byte, size)
+		return &buf
+	}
+	return p
+}
+
+// Get returns a buffer of the pool's size.
+func (p *bufferPool) Get() []byte {
+	return *p.pool.Get().(*[]byte)
+}
+
+// Put returns buf to the pool.
+func (p *bufferPool) Put(buf []byte) {
+	if cap(buf) < p.size {
+		return
+	}
+	buf = buf[:p.size]
+	p.pool.Put(&buf)
+}
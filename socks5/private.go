@@ -0,0 +1,78 @@
+package socks5
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// privateNetworks are the ranges Server.BlockPrivateNetworks refuses to
+// connect to.
+var privateNetworks = parseCIDRs(
+	"0.0.0.0/8",          // "this" network
+	"10.0.0.0/8",         // RFC 1918
+	"100.64.0.0/10",      // carrier-grade NAT, RFC 6598
+	"127.0.0.0/8",        // loopback
+	"169.254.0.0/16",     // link-local
+	"172.16.0.0/12",      // RFC 1918
+	"192.0.0.0/24",       // IETF protocol assignments, RFC 6890
+	"192.168.0.0/16",     // RFC 1918
+	"198.18.0.0/15",      // benchmarking, RFC 2544
+	"224.0.0.0/4",        // multicast
+	"240.0.0.0/4",        // reserved, RFC 1112
+	"255.255.255.255/32", // limited broadcast
+	"::/128",             // unspecified
+	"::1/128",            // loopback
+	"64:ff9b::/96",       // NAT64, which can reach any IPv4 address
+	"fc00::/7",           // unique local, RFC 4193
+	"fe80::/10",          // link-local
+	"ff00::/8",           // multicast
+)
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets[i] = n
+	}
+	return nets
+}
+
+// isPrivate reports whether ip is in one of privateNetworks.
+func isPrivate(ip net.IP) bool {
+	for _, n := range privateNetworks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPrivate returns a *ReplyError with ConnNotAllow if host is an IP in a
+// private network and s.BlockPrivateNetworks is set.
+func (s *Server) checkPrivate(host string) error {
+	if !s.BlockPrivateNetworks {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !isPrivate(ip) {
+		return nil
+	}
+	return &ReplyError{
+		REP: ConnNotAllow,
+		Err: fmt.Errorf("socks5: destination %s is in a private network", ip),
+	}
+}
+
+// controlPrivate is a net.Dialer Control function refusing connections to
+// private networks, so names the dialer resolves itself are checked too.
+func (s *Server) controlPrivate(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	return s.checkPrivate(host)
+}
@@ -0,0 +1,58 @@
+package socks5
+
+import (
+	"net"
+	"testing"
+)
+
+func TestIsPrivate(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"0.1.2.3", true},
+		{"10.1.2.3", true},
+		{"100.64.0.1", true},
+		{"100.128.0.1", false},
+		{"127.0.0.1", true},
+		{"169.254.1.1", true},
+		{"172.16.0.1", true},
+		{"172.32.0.1", false},
+		{"192.0.0.8", true},
+		{"192.0.1.1", false},
+		{"192.168.1.1", true},
+		{"198.18.0.1", true},
+		{"198.19.255.255", true},
+		{"198.20.0.1", false},
+		{"224.0.0.1", true},
+		{"239.255.255.250", true},
+		{"240.0.0.1", true},
+		{"255.255.255.255", true},
+		{"8.8.8.8", false},
+		{"::", true},
+		{"::1", true},
+		{"::ffff:127.0.0.1", true},
+		{"64:ff9b::a00:1", true},
+		{"64:ff9b:1::a00:1", false},
+		{"fd00::1", true},
+		{"fe80::1", true},
+		{"ff02::1", true},
+		{"2001:4860:4860::8888", false},
+	}
+	for _, tt := range tests {
+		if got := isPrivate(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("isPrivate(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestBlockPrivateNetworks(t *testing.T) {
+	s := &Server{BlockPrivateNetworks: true, Dialer: newPipeDialer()}
+	for _, dest := range []string{"127.0.0.1:80", "224.0.0.1:80", "[64:ff9b::7f00:1]:80"} {
+		conn := newFakeConn([]byte{V5, 1, NoAuth}, requestBytes(t, CONNECT, dest))
+		s.HandleClient(conn)
+		if out := conn.out.Bytes(); len(out) < 4 || out[3] != ConnNotAllow {
+			t.Errorf("CONNECT %s: client read %v, want ConnNotAllow", dest, out)
+		}
+	}
+}
@@ -4,13 +4,16 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"io"
 	"net"
+	"strconv"
 )
 
 // VER indicate protocol version
 type VER = uint8
 
 const (
+	V4 VER = 0x04
 	V5 VER = 0x05
 )
 
@@ -68,27 +71,67 @@ const (
 //		| 1  |  1  | X'00' |  1   | Variable |    2     |
 //		+----+-----+-------+------+----------+----------+
 type Request struct {
-	VER
-	CMD uint8
-	RSV uint8
-	ATYP
+	Ver  VER
+	CMD  uint8
+	RSV  uint8
+	Atyp ATYP
+	// DesTAddr holds the destination when ATYP is IPV4 or IPV6. Parsed IPv4
+	// addresses are stored in 16-byte form, as returned by net.ParseIP.
 	DesTAddr net.IP
+	// Domain holds the unresolved destination when ATYP is DOMAINNAME
+	Domain   string
 	DestPort uint16
 }
 
 //NewRequest returns a new Request given a Version param
 func NewRequest(ver VER) *Request {
 	return &Request{
-		VER: ver,
+		Ver: ver,
 		RSV: 0x00,
 	}
 }
 
+// NewRequestFromAddr returns a Request with the given version and command
+// for hostport, a host:port string as accepted by net.Dial. ATYP is IPV4 or
+// IPV6 when host is an IP literal, and DOMAINNAME otherwise. IPv4 addresses
+// are stored in 16-byte form, as DeserializeRequest does.
+func NewRequestFromAddr(ver VER, cmd CMD, hostport string) (*Request, error) {
+	host, portStr, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, errors.New("socks5: invalid port: " + portStr)
+	}
+
+	request := NewRequest(ver)
+	request.CMD = cmd
+	request.DestPort = uint16(port)
+	if ip := net.ParseIP(host); ip != nil {
+		request.Atyp = IPV6
+		if ip.To4() != nil {
+			request.Atyp = IPV4
+		}
+		request.DesTAddr = ip
+	} else {
+		if host == "" {
+			return nil, ErrEmptyDomain
+		}
+		if len(host) > 255 {
+			return nil, errors.New("socks5: host name too long")
+		}
+		request.Atyp = DOMAINNAME
+		request.Domain = host
+	}
+	return request, nil
+}
+
 //SerializeRequest serialize request to []byte
 func SerializeRequest(request Request) ([]byte, error) {
 	var content bytes.Buffer
 	var err error
-	err = content.WriteByte(request.VER)
+	err = content.WriteByte(request.Ver)
 	if err != nil {
 		return nil, err
 	}
@@ -100,11 +143,30 @@ func SerializeRequest(request Request) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	err = content.WriteByte(request.ATYP)
+	err = content.WriteByte(request.Atyp)
 	if err != nil {
 		return nil, err
 	}
-	_, err = content.Write(request.DesTAddr)
+	if request.Atyp == DOMAINNAME {
+		if len(request.Domain) == 0 {
+			return nil, ErrEmptyDomain
+		}
+		if len(request.Domain) > 255 {
+			return nil, errors.New("domain name is too long")
+		}
+		err = content.WriteByte(byte(len(request.Domain)))
+		if err != nil {
+			return nil, err
+		}
+		_, err = content.WriteString(request.Domain)
+	} else {
+		var ip net.IP
+		ip, err = addrBytes(request.Atyp, request.DesTAddr)
+		if err != nil {
+			return nil, err
+		}
+		_, err = content.Write(ip)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -118,10 +180,128 @@ func SerializeRequest(request Request) ([]byte, error) {
 	return content.Bytes(), nil
 }
 
+// ErrUnknownATYP is returned when a frame carries an address type other
+// than IPV4, IPV6 or DOMAINNAME.
+var ErrUnknownATYP = errors.New("unknown address type")
+
+// ErrUnknownCMD is returned when a request carries a command the server
+// does not support.
+var ErrUnknownCMD = errors.New("command not supported")
+
+// ErrVersionMismatch is returned when a frame carries an unexpected protocol
+// version.
+var ErrVersionMismatch = errors.New("unsupported version")
+
+// ErrInvalidRSV is returned when a request or reply has a non-zero RSV
+// field.
+var ErrInvalidRSV = errors.New("reserved field must be 0x00")
+
 // ErrReqLength is returned by DeserializeRequest function when content had
 // incorrect length.
 var ErrReqLength = errors.New("request length is incorrect")
 
+// ErrEmptyDomain is returned when a DOMAINNAME address has a length of zero.
+var ErrEmptyDomain = errors.New("domain name is empty")
+
+// maxFrameLen is the length of the longest request or reply frame.
+const maxFrameLen = 4 + 1 + 255 + 2
+
+// frameBuffers holds buffers used to read request frames.
+var frameBuffers = newBufferPool(maxFrameLen)
+
+// ReadRequest reads exactly one request frame from r: the fixed header
+// first, then the address whose length ATYP determines. Unlike a single
+// Read followed by DeserializeRequest, it copes with frames split across
+// reads and leaves any bytes following the frame unread.
+func ReadRequest(r io.Reader) (*Request, error) {
+	buf := frameBuffers.Get()
+	defer frameBuffers.Put(buf)
+
+	content, err := readFrame(r, buf)
+	if err != nil {
+		return nil, err
+	}
+	return DeserializeRequest(content)
+}
+
+// readFrame reads one request or reply frame from r, the fixed header first
+// and then the variable-length address selected by ATYP. Both frames share
+// the same layout. buf must have a capacity of at least maxFrameLen.
+func readFrame(r io.Reader, buf []byte) ([]byte, error) {
+	content := buf[:4]
+	_, err := io.ReadFull(r, content)
+	if err != nil {
+		return nil, err
+	}
+
+	var addrLen int
+	switch content[3] {
+	case IPV4:
+		addrLen = net.IPv4len
+	case IPV6:
+		addrLen = net.IPv6len
+	case DOMAINNAME:
+		domainLen := make([]byte, 1)
+		_, err = io.ReadFull(r, domainLen)
+		if err != nil {
+			return nil, err
+		}
+		content = append(content, domainLen[0])
+		addrLen = int(domainLen[0])
+	default:
+		return nil, ErrUnknownATYP
+	}
+
+	rest := content[len(content) : len(content)+addrLen+2]
+	_, err = io.ReadFull(r, rest)
+	if err != nil {
+		return nil, err
+	}
+	return content[:len(content)+len(rest)], nil
+}
+
+// addrBytes returns ip in the 4 or 16 byte form required by atyp, which must
+// be IPV4 or IPV6.
+func addrBytes(atyp ATYP, ip net.IP) (net.IP, error) {
+	switch atyp {
+	case IPV4:
+		if ip4 := ip.To4(); ip4 != nil {
+			return ip4, nil
+		}
+		return nil, errors.New("address is not an ipv4 address")
+	case IPV6:
+		if len(ip) == net.IPv6len {
+			return ip, nil
+		}
+		if ip16 := ip.To16(); ip16 != nil {
+			return ip16, nil
+		}
+		return nil, errors.New("address is not an ipv6 address")
+	default:
+		return nil, ErrUnknownATYP
+	}
+}
+
+// copyIP returns a copy of ip that does not share memory with the buffer it
+// was parsed from. IPv4 addresses are always returned in their 16-byte
+// IPv4-mapped form, matching net.ParseIP, so parsed addresses compare equal
+// regardless of how they were encoded.
+func copyIP(ip []byte) net.IP {
+	if len(ip) == net.IPv4len {
+		return net.IPv4(ip[0], ip[1], ip[2], ip[3])
+	}
+	return append(net.IP(nil), ip...)
+}
+
+// WriteRequest serializes request and writes all of it to w.
+func WriteRequest(w io.Writer, request *Request) error {
+	content, err := SerializeRequest(*request)
+	if err != nil {
+		return err
+	}
+	return writeAll(w, content)
+}
+
 // DeserializeRequest deserialize content to a request
 func DeserializeRequest(content []byte) (*Request, error) {
 	contentLen := len(content)
@@ -133,38 +313,44 @@ func DeserializeRequest(content []byte) (*Request, error) {
 		return nil, errors.New("request is too short")
 	}
 
+	if content[0] != V5 {
+		return nil, ErrVersionMismatch
+	}
+
 	req := new(Request)
-	req.VER = content[0]
+	req.Ver = content[0]
 	req.CMD = content[1]
 	req.RSV = content[2]
-	req.ATYP = content[3]
+	req.Atyp = content[3]
 
-	switch req.ATYP {
+	switch req.Atyp {
 	case IPV4:
 		if contentLen != 6+net.IPv4len {
 			return nil, ErrReqLength
 		}
-		req.DesTAddr = content[4:8]
+		req.DesTAddr = copyIP(content[4:8])
 		req.DestPort = binary.BigEndian.Uint16(content[8:])
 	case IPV6:
 		if contentLen != 6+net.IPv6len {
 			return nil, ErrReqLength
 		}
-		req.DesTAddr = content[4:20]
+		req.DesTAddr = copyIP(content[4:20])
 		req.DestPort = binary.BigEndian.Uint16(content[20:])
 	case DOMAINNAME:
+		if contentLen < 5 {
+			return nil, ErrReqLength
+		}
+		if content[4] == 0 {
+			return nil, ErrEmptyDomain
+		}
 		addressLen := int(content[4]) + 6 + 1
 		if contentLen != addressLen {
 			return nil, ErrReqLength
 		}
-		ipAddr, err := net.ResolveIPAddr("ip", string(content[4:addressLen]))
-		if err != nil {
-			return nil, err
-		}
-		req.DesTAddr = ipAddr.IP
-		req.DestPort = binary.BigEndian.Uint16(content[addressLen:])
+		req.Domain = string(content[5 : addressLen-2])
+		req.DestPort = binary.BigEndian.Uint16(content[addressLen-2:])
 	default:
-		return nil, errors.New("unknown address type")
+		return nil, ErrUnknownATYP
 	}
 	return req, nil
 }
@@ -181,27 +367,56 @@ func DeserializeRequest(content []byte) (*Request, error) {
 //		| 1  |  1  | X'00' |  1   | Variable |    2     |
 //		+----+-----+-------+------+----------+----------+
 type Reply struct {
-	VER
+	Ver VER
 	REP
-	RSV uint8
-	ATYP
+	RSV  uint8
+	Atyp ATYP
+	// BNDAddr holds the bound address when ATYP is IPV4 or IPV6. Parsed IPv4
+	// addresses are stored in 16-byte form, as returned by net.ParseIP.
 	BNDAddr net.IP
+	// Domain holds the bound address when ATYP is DOMAINNAME
+	Domain  string
 	BNDPort uint16
 }
 
 // NewReply returns a new Reply given a Version param
 func NewReply(ver VER) *Reply {
 	return &Reply{
-		VER: ver,
+		Ver: ver,
 		RSV: 0x00,
 	}
 }
 
+// ErrNotIPAddr is returned by NewReplyFromAddr when addr has no IP address
+// and port, e.g. a Unix domain socket address.
+var ErrNotIPAddr = errors.New("address is not an IP address")
+
+// NewReplyFromAddr returns a Reply with the given version and REP whose bound
+// address is addr, typically the LocalAddr of a connection. ATYP is IPV4 for
+// IPv4 addresses, IPv4-mapped ones included, and IPV6 otherwise.
+func NewReplyFromAddr(ver VER, rep REP, addr net.Addr) (*Reply, error) {
+	ip, port := splitAddr(addr)
+	if ip == nil {
+		return nil, ErrNotIPAddr
+	}
+	reply := NewReply(ver)
+	reply.REP = rep
+	if ip4 := ip.To4(); ip4 != nil {
+		reply.Atyp = IPV4
+		reply.BNDAddr = ip4
+	} else {
+		reply.Atyp = IPV6
+		reply.BNDAddr = ip.To16()
+	}
+	reply.BNDPort = uint16(port)
+	return reply, nil
+}
+
 // SerializeReply serialize reply to []byte
 func SerializeReply(reply Reply) ([]byte, error) {
 	var content bytes.Buffer
 	var err error
-	err = content.WriteByte(reply.VER)
+	err = content.WriteByte(reply.Ver)
 	if err != nil {
 		return nil, err
 	}
@@ -209,15 +424,37 @@ func SerializeReply(reply Reply) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	if reply.RSV != 0x00 {
+		return nil, ErrInvalidRSV
+	}
 	err = content.WriteByte(reply.RSV)
 	if err != nil {
 		return nil, err
 	}
-	err = content.WriteByte(reply.ATYP)
+	err = content.WriteByte(reply.Atyp)
 	if err != nil {
 		return nil, err
 	}
-	_, err = content.Write(reply.BNDAddr)
+	if reply.Atyp == DOMAINNAME {
+		if len(reply.Domain) == 0 {
+			return nil, ErrEmptyDomain
+		}
+		if len(reply.Domain) > 255 {
+			return nil, errors.New("domain name is too long")
+		}
+		err = content.WriteByte(byte(len(reply.Domain)))
+		if err != nil {
+			return nil, err
+		}
+		_, err = content.WriteString(reply.Domain)
+	} else {
+		var ip net.IP
+		ip, err = addrBytes(reply.Atyp, reply.BNDAddr)
+		if err != nil {
+			return nil, err
+		}
+		_, err = content.Write(ip)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -231,6 +468,24 @@ func SerializeReply(reply Reply) ([]byte, error) {
 	return content.Bytes(), nil
 }
 
+// ReadReply reads exactly one reply frame from r, like ReadRequest.
+func ReadReply(r io.Reader) (*Reply, error) {
+	content, err := readFrame(r, make([]byte, maxFrameLen))
+	if err != nil {
+		return nil, err
+	}
+	return DeserializeReply(content)
+}
+
+// WriteReply serializes reply and writes all of it to w.
+func WriteReply(w io.Writer, reply *Reply) error {
+	content, err := SerializeReply(*reply)
+	if err != nil {
+		return err
+	}
+	return writeAll(w, content)
+}
+
 // DeserializeReply deserialize content to a reply
 func DeserializeReply(content []byte) (*Reply, error) {
 	contentLen := len(content)
@@ -242,38 +497,44 @@ func DeserializeReply(content []byte) (*Reply, error) {
 		return nil, errors.New("request is too short")
 	}
 
+	if content[0] != V5 {
+		return nil, ErrVersionMismatch
+	}
+
 	reply := new(Reply)
-	reply.VER = content[0]
+	reply.Ver = content[0]
 	reply.REP = content[1]
 	reply.RSV = content[2]
-	reply.ATYP = content[3]
+	reply.Atyp = content[3]
 
-	switch reply.ATYP {
+	switch reply.Atyp {
 	case IPV4:
 		if contentLen != 6+net.IPv4len {
 			return nil, ErrReqLength
 		}
-		reply.BNDAddr = content[4:8]
+		reply.BNDAddr = copyIP(content[4:8])
 		reply.BNDPort = binary.BigEndian.Uint16(content[8:])
 	case IPV6:
 		if contentLen != 6+net.IPv6len {
 			return nil, ErrReqLength
 		}
-		reply.BNDAddr = content[4:20]
+		reply.BNDAddr = copyIP(content[4:20])
 		reply.BNDPort = binary.BigEndian.Uint16(content[20:])
 	case DOMAINNAME:
+		if contentLen < 5 {
+			return nil, ErrReqLength
+		}
+		if content[4] == 0 {
+			return nil, ErrEmptyDomain
+		}
 		addressLen := int(content[4]) + 6 + 1
 		if contentLen != addressLen {
 			return nil, ErrReqLength
 		}
-		ipAddr, err := net.ResolveIPAddr("ip", string(content[4:addressLen]))
-		if err != nil {
-			return nil, err
-		}
-		reply.BNDAddr = ipAddr.IP
-		reply.BNDPort = binary.BigEndian.Uint16(content[addressLen:])
+		reply.Domain = string(content[5 : addressLen-2])
+		reply.BNDPort = binary.BigEndian.Uint16(content[addressLen-2:])
 	default:
-		return nil, errors.New("unknown address type")
+		return nil, ErrUnknownATYP
 	}
 	return reply, nil
 }
@@ -0,0 +1,255 @@
+package socks5
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+	"testing/iotest"
+)
+
+func TestIPv4Form(t *testing.T) {
+	want := net.ParseIP("10.0.0.1")
+
+	parsed, err := DeserializeRequest([]byte{V5, CONNECT, 0x00, IPV4, 10, 0, 0, 1, 0, 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	built, err := NewRequestFromAddr(V5, CONNECT, "10.0.0.1:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := DeserializeReply([]byte{V5, Succeeded, 0x00, IPV4, 10, 0, 0, 1, 0, 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, ip := range map[string]net.IP{
+		"DeserializeRequest": parsed.DesTAddr,
+		"NewRequestFromAddr": built.DesTAddr,
+		"DeserializeReply":   reply.BNDAddr,
+	} {
+		if !bytes.Equal(ip, want) {
+			t.Errorf("%s stored %v (%d bytes), want the %d-byte form of net.ParseIP", name, []byte(ip), len(ip), len(want))
+		}
+	}
+}
+
+func FuzzDeserializeRequest(f *testing.F) {
+	f.Add([]byte{V5, CONNECT, 0x00, IPV4, 10, 0, 0, 1, 0, 80})
+	f.Add(append([]byte{V5, CONNECT, 0x00, IPV6}, make([]byte, 18)...))
+	f.Add(append([]byte{V5, CONNECT, 0x00, DOMAINNAME, 4}, "a.io\x00\x50"...))
+	f.Add([]byte{V5, CONNECT, 0x00, DOMAINNAME, 0xff})
+	f.Fuzz(func(t *testing.T, content []byte) {
+		request, err := DeserializeRequest(content)
+		if err != nil {
+			return
+		}
+		again, err := SerializeRequest(*request)
+		if err != nil {
+			t.Fatalf("SerializeRequest of a parsed request: %v", err)
+		}
+		if !bytes.Equal(again, content) {
+			t.Fatalf("SerializeRequest = %v, want the parsed frame %v", again, content)
+		}
+	})
+}
+
+func FuzzDeserializeReply(f *testing.F) {
+	f.Add([]byte{V5, Succeeded, 0x00, IPV4, 10, 0, 0, 1, 0, 80})
+	f.Add(append([]byte{V5, HostUnreachable, 0x00, IPV6}, make([]byte, 18)...))
+	f.Add(append([]byte{V5, Succeeded, 0x00, DOMAINNAME, 4}, "a.io\x00\x50"...))
+	f.Add([]byte{V5, Succeeded, 0x00, DOMAINNAME, 0xff})
+	f.Fuzz(func(t *testing.T, content []byte) {
+		reply, err := DeserializeReply(content)
+		if err != nil {
+			return
+		}
+		// replies are only sent with RSV 0x00, but read leniently
+		if reply.RSV != 0x00 {
+			return
+		}
+		again, err := SerializeReply(*reply)
+		if err != nil {
+			t.Fatalf("SerializeReply of a parsed reply: %v", err)
+		}
+		if !bytes.Equal(again, content) {
+			t.Fatalf("SerializeReply = %v, want the parsed frame %v", again, content)
+		}
+	})
+}
+
+func TestReadRequestOneByteChunks(t *testing.T) {
+	for _, hostport := range []string{"10.0.0.1:80", "[2001:db8::1]:443", "example.com:8080"} {
+		b, err := SerializeRequest(*mustRequest(t, hostport))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// a trailing byte must be left for whatever follows the request
+		r := bytes.NewReader(append(b, 0xAA))
+		request, err := ReadRequest(iotest.OneByteReader(r))
+		if err != nil {
+			t.Errorf("%s: ReadRequest: %v", hostport, err)
+			continue
+		}
+		if !reflect.DeepEqual(request, mustRequest(t, hostport)) {
+			t.Errorf("%s: ReadRequest = %+v", hostport, request)
+		}
+		if r.Len() != 1 {
+			t.Errorf("%s: ReadRequest left %d bytes unread, want 1", hostport, r.Len())
+		}
+
+		// the server frames it the same way
+		d := newPipeDialer()
+		conn := &fakeConn{in: iotest.OneByteReader(bytes.NewReader(append([]byte{V5, 1, NoAuth}, b...)))}
+		go func() { (<-d.peers).Close() }()
+		(&Server{Dialer: d, RemoteDNS: true}).HandleClient(conn)
+		if out := conn.out.Bytes(); len(out) < 4 || out[3] != Succeeded {
+			t.Errorf("%s: client read %v, want a Succeeded reply", hostport, out)
+		}
+	}
+}
+
+func mustRequest(t *testing.T, hostport string) *Request {
+	t.Helper()
+	request, err := NewRequestFromAddr(V5, CONNECT, hostport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return request
+}
+
+func TestSerializeRequestDomainRoundTrip(t *testing.T) {
+	request := Request{Ver: V5, CMD: CONNECT, Atyp: DOMAINNAME, Domain: "example.com", DestPort: 443}
+	content, err := SerializeRequest(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := append([]byte{V5, CONNECT, 0x00, DOMAINNAME, 11}, "example.com\x01\xbb"...)
+	if !bytes.Equal(content, want) {
+		t.Fatalf("SerializeRequest = %v, want %v", content, want)
+	}
+
+	got, err := DeserializeRequest(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(*got, request) {
+		t.Errorf("DeserializeRequest = %+v, want %+v", *got, request)
+	}
+}
+
+func TestRequestCodec(t *testing.T) {
+	tests := []struct {
+		name    string
+		request Request
+		want    []byte
+	}{
+		{
+			name:    "IPV4",
+			request: Request{Ver: V5, CMD: CONNECT, Atyp: IPV4, DesTAddr: net.ParseIP("10.0.0.1"), DestPort: 80},
+			want:    []byte{V5, CONNECT, 0x00, IPV4, 10, 0, 0, 1, 0, 80},
+		},
+		{
+			name:    "IPV6",
+			request: Request{Ver: V5, CMD: BIND, Atyp: IPV6, DesTAddr: net.ParseIP("2001:db8::1"), DestPort: 8080},
+			want: []byte{V5, BIND, 0x00, IPV6,
+				0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x1f, 0x90},
+		},
+		{
+			name:    "DOMAINNAME",
+			request: Request{Ver: V5, CMD: UDPASSOCIATE, Atyp: DOMAINNAME, Domain: "a.io", DestPort: 53},
+			want:    []byte{V5, UDPASSOCIATE, 0x00, DOMAINNAME, 4, 'a', '.', 'i', 'o', 0, 53},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content, err := SerializeRequest(tt.request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(content, tt.want) {
+				t.Fatalf("SerializeRequest = %v, want %v", content, tt.want)
+			}
+			got, err := DeserializeRequest(content)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(*got, tt.request) {
+				t.Errorf("DeserializeRequest = %+v, want %+v", *got, tt.request)
+			}
+		})
+	}
+}
+
+func TestReplyCodec(t *testing.T) {
+	tests := []struct {
+		name  string
+		reply Reply
+		want  []byte
+	}{
+		{
+			name:  "IPV4",
+			reply: Reply{Ver: V5, REP: Succeeded, Atyp: IPV4, BNDAddr: net.ParseIP("192.0.2.7"), BNDPort: 1080},
+			want:  []byte{V5, Succeeded, 0x00, IPV4, 192, 0, 2, 7, 0x04, 0x38},
+		},
+		{
+			name:  "IPV6",
+			reply: Reply{Ver: V5, REP: HostUnreachable, Atyp: IPV6, BNDAddr: net.IPv6loopback, BNDPort: 1},
+			want: []byte{V5, HostUnreachable, 0x00, IPV6,
+				0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 1},
+		},
+		{
+			name:  "DOMAINNAME",
+			reply: Reply{Ver: V5, REP: Succeeded, Atyp: DOMAINNAME, Domain: "proxy", BNDPort: 1080},
+			want:  []byte{V5, Succeeded, 0x00, DOMAINNAME, 5, 'p', 'r', 'o', 'x', 'y', 0x04, 0x38},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content, err := SerializeReply(tt.reply)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(content, tt.want) {
+				t.Fatalf("SerializeReply = %v, want %v", content, tt.want)
+			}
+			got, err := DeserializeReply(content)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(*got, tt.reply) {
+				t.Errorf("DeserializeReply = %+v, want %+v", *got, tt.reply)
+			}
+		})
+	}
+}
+
+func TestDeserializeVersion(t *testing.T) {
+	frame := []byte{V4, CONNECT, 0x00, IPV4, 10, 0, 0, 1, 0, 80}
+	if _, err := DeserializeRequest(frame); err != ErrVersionMismatch {
+		t.Errorf("DeserializeRequest: %v, want %v", err, ErrVersionMismatch)
+	}
+	if _, err := DeserializeReply(frame); err != ErrVersionMismatch {
+		t.Errorf("DeserializeReply: %v, want %v", err, ErrVersionMismatch)
+	}
+}
+
+func TestDeserializeTruncatedDomain(t *testing.T) {
+	frame := append([]byte{V5, CONNECT, 0x00, DOMAINNAME, 11}, "example.com\x00\x50"...)
+	for n := 0; n < len(frame); n++ {
+		if _, err := DeserializeRequest(frame[:n]); err == nil {
+			t.Errorf("DeserializeRequest of the first %d bytes succeeded", n)
+		}
+		if _, err := ReadRequest(bytes.NewReader(frame[:n])); err == nil {
+			t.Errorf("ReadRequest of the first %d bytes succeeded", n)
+		}
+	}
+
+	empty := []byte{V5, CONNECT, 0x00, DOMAINNAME, 0, 0, 80}
+	if _, err := DeserializeRequest(empty); err != ErrEmptyDomain {
+		t.Errorf("DeserializeRequest of an empty domain: %v, want %v", err, ErrEmptyDomain)
+	}
+	if _, err := ReadRequest(bytes.NewReader(empty)); err != ErrEmptyDomain {
+		t.Errorf("ReadRequest of an empty domain: %v, want %v", err, ErrEmptyDomain)
+	}
+}
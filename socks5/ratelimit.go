@@ -0,0 +1,66 @@
+package socks5
+
+import (
+	"context"
+	"net"
+
+	"golang.org/x/time/rate"
+)
+
+// throttledConn limits the rate data is written to it to bytesPerSec, with a
+// burst of a second's worth. Writes are passed on in chunks of a tenth of a
+// second's worth of bytes, so a large write makes steady progress instead of
+// waiting off its whole deficit first, and the deadlines an idleTimeoutConn
+// pushes on each write keep moving. Closing the connection, or cancelling the
+// context it was created with, interrupts a waiting Write.
+type throttledConn struct {
+	net.Conn
+	limiter *rate.Limiter
+	chunk   int
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+func newThrottledConn(ctx context.Context, conn net.Conn, bytesPerSec int64) *throttledConn {
+	chunk := int(bytesPerSec / 10)
+	if chunk < 1 {
+		chunk = 1
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	return &throttledConn{
+		Conn:    conn,
+		limiter: rate.NewLimiter(rate.Limit(bytesPerSec), int(bytesPerSec)),
+		chunk:   chunk,
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+}
+
+func (c *throttledConn) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > c.chunk {
+			chunk = chunk[:c.chunk]
+		}
+		if err := c.limiter.WaitN(c.ctx, len(chunk)); err != nil {
+			return written, err
+		}
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+func (c *throttledConn) Close() error {
+	c.cancel()
+	return c.Conn.Close()
+}
+
+func (c *throttledConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
@@ -0,0 +1,72 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// echoThrottled sends n bytes through a server with s's settings to an echo
+// server, and returns what came back and how long it took.
+func echoThrottled(t *testing.T, s *Server, n int) ([]byte, time.Duration) {
+	t.Helper()
+	conn := dialNoAuth(t, startServer(t, s))
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	reply := sendRequest(t, conn, CONNECT, startEcho(t))
+	if reply.REP != Succeeded {
+		t.Fatalf("REP = %#x, want Succeeded", reply.REP)
+	}
+	start := time.Now()
+	go conn.Write(bytes.Repeat([]byte{'x'}, n))
+	got, _ := io.ReadAll(io.LimitReader(conn, int64(n)))
+	return got, time.Since(start)
+}
+
+func TestPerConnRateLimit(t *testing.T) {
+	const n = 12 * 1024
+	got, elapsed := echoThrottled(t, &Server{PerConnRateLimit: 4096}, n)
+	if len(got) != n {
+		t.Fatalf("echoed %d bytes, want %d", len(got), n)
+	}
+	// the first second's worth is sent at once, the remaining 8KiB cannot
+	// take less than 2s at 4KiB/s
+	if elapsed < 2*time.Second-50*time.Millisecond {
+		t.Errorf("12KiB at 4KiB/s took %v, want at least 2s", elapsed)
+	}
+}
+
+func TestPerConnRateLimitIdleTimeout(t *testing.T) {
+	// a throttled transfer is progress, not idleness
+	const n = 12 * 1024
+	got, _ := echoThrottled(t, &Server{PerConnRateLimit: 4096, IdleTimeout: time.Second}, n)
+	if len(got) != n {
+		t.Errorf("echoed %d bytes, want %d", len(got), n)
+	}
+}
+
+func TestThrottledConnClose(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	go io.Copy(io.Discard, b)
+	c := newThrottledConn(context.Background(), a, 1)
+
+	errc := make(chan error, 1)
+	go func() {
+		// the first byte is the burst; the rest would take a minute
+		_, err := c.Write(make([]byte, 60))
+		errc <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	c.Close()
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Error("Write succeeded on a closed connection")
+		}
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("Close did not interrupt a throttled Write")
+	}
+}
@@ -0,0 +1,271 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// relay copies data between the client and the upstream target applying the
+// server's relay settings, and adds the bytes copied to stats.
+func (s *Server) relay(ctx context.Context, client, target net.Conn, stats *ConnStats) error {
+	if s.KeepAlivePeriod > 0 {
+		setKeepAlive(client, s.KeepAlivePeriod)
+		setKeepAlive(target, s.KeepAlivePeriod)
+	}
+	setNoDelay(client, !s.DisableNoDelay)
+	setNoDelay(target, !s.DisableNoDelay)
+	var limit time.Time
+	if s.MaxSessionDuration > 0 {
+		limit = stats.Start.Add(s.MaxSessionDuration)
+		client.SetDeadline(limit)
+		target.SetDeadline(limit)
+	}
+	if s.IdleTimeout > 0 {
+		deadline := capDeadline(time.Now().Add(s.IdleTimeout), limit)
+		client.SetReadDeadline(deadline)
+		target.SetReadDeadline(deadline)
+		client, target = &idleTimeoutConn{Conn: client, peer: target, timeout: s.IdleTimeout, limit: limit},
+			&idleTimeoutConn{Conn: target, peer: client, timeout: s.IdleTimeout, limit: limit}
+	}
+	if s.PerConnRateLimit > 0 {
+		client, target = newThrottledConn(ctx, client, s.PerConnRateLimit),
+			newThrottledConn(ctx, target, s.PerConnRateLimit)
+	}
+	if s.OnThroughput != nil {
+		var up, down int64
+		client, target = &countingConn{Conn: client, n: &up}, &countingConn{Conn: target, n: &down}
+		stop := s.sampleThroughput(connContext(ctx), &up, &down)
+		defer stop()
+	}
+	up, down, err := relay(client, target, s.buffers())
+	stats.BytesUp += up
+	stats.BytesDown += down
+	s.metrics().OnBytesRelayed(up + down)
+	return err
+}
+
+// keepAliveConn is implemented by connections that support TCP keep-alive,
+// such as *net.TCPConn.
+type keepAliveConn interface {
+	SetKeepAlive(keepalive bool) error
+	SetKeepAlivePeriod(d time.Duration) error
+}
+
+// noDelayConn is implemented by connections that support TCP_NODELAY, such
+// as *net.TCPConn.
+type noDelayConn interface {
+	SetNoDelay(noDelay bool) error
+}
+
+// unwrapConn returns the connection conn wraps, if it is a *bufferedConn.
+func unwrapConn(conn net.Conn) net.Conn {
+	if bc, ok := conn.(*bufferedConn); ok {
+		return bc.Conn
+	}
+	return conn
+}
+
+// setKeepAlive enables TCP keep-alive with the given period on conn, if it
+// supports it.
+func setKeepAlive(conn net.Conn, period time.Duration) {
+	if kc, ok := unwrapConn(conn).(keepAliveConn); ok {
+		kc.SetKeepAlive(true)
+		kc.SetKeepAlivePeriod(period)
+	}
+}
+
+// setNoDelay sets TCP_NODELAY on conn, if it supports it.
+func setNoDelay(conn net.Conn, noDelay bool) {
+	if nc, ok := unwrapConn(conn).(noDelayConn); ok {
+		nc.SetNoDelay(noDelay)
+	}
+}
+
+// sampleThroughput calls s.OnThroughput with the counters up and down every
+// ThroughputInterval until the returned function is called.
+func (s *Server) sampleThroughput(cc *ConnContext, up, down *int64) (stop func()) {
+	interval := s.ThroughputInterval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.OnThroughput(cc, atomic.LoadInt64(up), atomic.LoadInt64(down))
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// buffers returns the pool of relay buffers sized by s.BufferSize.
+func (s *Server) buffers() *bufferPool {
+	s.bufOnce.Do(func() {
+		size := s.BufferSize
+		if size <= 0 {
+			size = defaultBufferSize
+		}
+		s.bufs = newBufferPool(size)
+	})
+	return s.bufs
+}
+
+// relay copies data between a and b in both directions, using buffers from
+// bufs, and returns the number of bytes copied each way along with the first
+// error other than EOF.
+//
+// When one side reaches EOF and the other can close its write half, as a
+// *net.TCPConn can, only that half is closed, so the opposite direction
+// keeps flowing until it ends too. This lets protocols like HTTP finish
+// sending and still read the response. Otherwise, or on error, both
+// connections are closed at once.
+func relay(a, b net.Conn, bufs *bufferPool) (aToB, bToA int64, err error) {
+	type result struct {
+		toB    bool
+		n      int64
+		err    error
+		closed bool
+	}
+	results := make(chan result, 2)
+	pipe := func(dst, src net.Conn, toB bool) {
+		buf := bufs.Get()
+		defer bufs.Put(buf)
+		n, err := io.CopyBuffer(writerOnly{dst}, readerOnly{src}, buf)
+		closed := false
+		if err == nil {
+			closed = closeWrite(dst) == nil
+		}
+		results <- result{toB, n, err, closed}
+	}
+	go pipe(b, a, true)
+	go pipe(a, b, false)
+
+	torn := false
+	for i := 0; i < 2; i++ {
+		r := <-results
+		if r.toB {
+			aToB = r.n
+		} else {
+			bToA = r.n
+		}
+		// errors after tearing down are caused by the teardown itself
+		if r.err != nil && !torn {
+			err = r.err
+		}
+		if !r.closed && !torn {
+			a.Close()
+			b.Close()
+			torn = true
+		}
+	}
+	a.Close()
+	b.Close()
+	return aToB, bToA, err
+}
+
+// writerOnly and readerOnly hide the ReadFrom and WriteTo methods of a
+// *net.TCPConn, which would make io.CopyBuffer ignore the pooled buffer and
+// allocate one of its own.
+type writerOnly struct {
+	io.Writer
+}
+
+type readerOnly struct {
+	io.Reader
+}
+
+// closeWriter is implemented by connections that can close their write half,
+// such as *net.TCPConn and *tls.Conn.
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// errNoCloseWrite is returned by closeWrite for connections that cannot close
+// their write half.
+var errNoCloseWrite = errors.New("connection does not support CloseWrite")
+
+// closeWrite closes the write half of conn, if it supports it.
+func closeWrite(conn net.Conn) error {
+	if cw, ok := conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errNoCloseWrite
+}
+
+// idleTimeoutConn pushes the read deadline of itself and its peer forward
+// after every successful Read or Write, so the relay only fails once both
+// directions have made no progress for timeout. The deadline is never pushed
+// past limit, if set.
+type idleTimeoutConn struct {
+	net.Conn
+	peer    net.Conn
+	timeout time.Duration
+	limit   time.Time
+}
+
+func (c *idleTimeoutConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.extend()
+	}
+	return n, err
+}
+
+func (c *idleTimeoutConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.extend()
+	}
+	return n, err
+}
+
+// extend pushes the read deadlines of c and its peer timeout from now.
+func (c *idleTimeoutConn) extend() {
+	deadline := capDeadline(time.Now().Add(c.timeout), c.limit)
+	c.Conn.SetReadDeadline(deadline)
+	c.peer.SetReadDeadline(deadline)
+}
+
+func (c *idleTimeoutConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+// capDeadline returns the earlier of deadline and limit, ignoring a zero
+// limit.
+func capDeadline(deadline, limit time.Time) time.Time {
+	if !limit.IsZero() && limit.Before(deadline) {
+		return limit
+	}
+	return deadline
+}
+
+// countingConn atomically adds the number of bytes read from it to n.
+type countingConn struct {
+	net.Conn
+	n *int64
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
+
+func (c *countingConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
@@ -0,0 +1,172 @@
+package socks5
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// tcpPair returns the two ends of a loopback TCP connection.
+func tcpPair(tb testing.TB) (*net.TCPConn, *net.TCPConn) {
+	tb.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	peer := <-accepted
+	if peer == nil {
+		tb.Fatal("accept failed")
+	}
+	return conn.(*net.TCPConn), peer.(*net.TCPConn)
+}
+
+func benchmarkRelay(b *testing.B, pool func() *bufferPool) {
+	payload := make([]byte, 64*1024)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(payload)))
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		client, a := tcpPair(b)
+		bEnd, target := tcpPair(b)
+		bufs := pool()
+		b.StartTimer()
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			io.Copy(io.Discard, target)
+			target.Close()
+		}()
+		go func() {
+			client.Write(payload)
+			client.CloseWrite()
+		}()
+		relay(a, bEnd, bufs)
+		<-done
+		client.Close()
+	}
+}
+
+// BenchmarkRelay compares relaying with a shared buffer pool, as the server
+// does, against allocating fresh buffers for every connection.
+func BenchmarkRelay(b *testing.B) {
+	b.Run("pooled", func(b *testing.B) {
+		bufs := newBufferPool(defaultBufferSize)
+		benchmarkRelay(b, func() *bufferPool { return bufs })
+	})
+	b.Run("unpooled", func(b *testing.B) {
+		benchmarkRelay(b, func() *bufferPool { return newBufferPool(defaultBufferSize) })
+	})
+}
+
+// optsConn records the TCP options set on it.
+type optsConn struct {
+	net.Conn
+	keepAlive       bool
+	keepAlivePeriod time.Duration
+	noDelay         *bool
+}
+
+func (c *optsConn) SetKeepAlive(keepalive bool) error {
+	c.keepAlive = keepalive
+	return nil
+}
+
+func (c *optsConn) SetKeepAlivePeriod(d time.Duration) error {
+	c.keepAlivePeriod = d
+	return nil
+}
+
+func (c *optsConn) SetNoDelay(noDelay bool) error {
+	c.noDelay = &noDelay
+	return nil
+}
+
+// relayOpts runs s.relay between two optsConns whose peers are already
+// closed, and returns them once the relay is done. The client side is wrapped
+// in a *bufferedConn as it is when served.
+func relayOpts(t *testing.T, s *Server) (client, target *optsConn) {
+	t.Helper()
+	clientEnd, clientPeer := net.Pipe()
+	targetEnd, targetPeer := net.Pipe()
+	clientPeer.Close()
+	targetPeer.Close()
+	client, target = &optsConn{Conn: clientEnd}, &optsConn{Conn: targetEnd}
+	s.relay(context.Background(), newBufferedConn(client), target, &ConnStats{Start: time.Now()})
+	return client, target
+}
+
+func TestRelayKeepAlive(t *testing.T) {
+	client, target := relayOpts(t, &Server{KeepAlivePeriod: 42 * time.Second})
+	for _, c := range []*optsConn{client, target} {
+		if !c.keepAlive || c.keepAlivePeriod != 42*time.Second {
+			t.Errorf("keep-alive = %v, %v, want true, 42s", c.keepAlive, c.keepAlivePeriod)
+		}
+	}
+
+	client, target = relayOpts(t, &Server{})
+	for _, c := range []*optsConn{client, target} {
+		if c.keepAlive || c.keepAlivePeriod != 0 {
+			t.Errorf("keep-alive changed to %v, %v with no KeepAlivePeriod", c.keepAlive, c.keepAlivePeriod)
+		}
+	}
+}
+
+func TestRelayNoDelay(t *testing.T) {
+	for _, disable := range []bool{false, true} {
+		client, target := relayOpts(t, &Server{DisableNoDelay: disable})
+		for _, c := range []*optsConn{client, target} {
+			if c.noDelay == nil || *c.noDelay != !disable {
+				t.Errorf("DisableNoDelay %v: SetNoDelay(%v), want SetNoDelay(%v)", disable, c.noDelay, !disable)
+			}
+		}
+	}
+}
+
+func TestRelayHalfClose(t *testing.T) {
+	// the destination only answers once the client is done sending
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		request, _ := io.ReadAll(conn)
+		conn.Write(append([]byte("got "), request...))
+	}()
+
+	conn := dialNoAuth(t, startServer(t, &Server{}))
+	reply := sendRequest(t, conn, CONNECT, ln.Addr().String())
+	if reply.REP != Succeeded {
+		t.Fatalf("REP = %#x, want Succeeded", reply.REP)
+	}
+	conn.Write([]byte("request"))
+	err = conn.(*net.TCPConn).CloseWrite()
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(response) != "got request" {
+		t.Errorf("response = %q, want %q", response, "got request")
+	}
+}
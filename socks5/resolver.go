@@ -0,0 +1,72 @@
+package socks5
+
+import (
+	"context"
+	"net"
+)
+
+// Resolver resolves the host of DOMAINNAME requests when they are dialed.
+// CONNECT tries the returned addresses in order until one connects.
+//
+// A Resolver may return no IPs and a nil error to leave the host
+// unresolved; the domain name is then passed to the Dialer as is. Combined
+// with a Dialer that forwards to an upstream proxy, this keeps DNS lookups
+// off the local host entirely.
+type Resolver interface {
+	Resolve(ctx context.Context, host string) ([]net.IP, error)
+}
+
+// systemResolver resolves hosts with net.DefaultResolver.
+type systemResolver struct{}
+
+func (systemResolver) Resolve(ctx context.Context, host string) ([]net.IP, error) {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, addr := range addrs {
+		ips[i] = addr.IP
+	}
+	return ips, nil
+}
+
+// resolve returns the candidate hosts to dial, in order, for a destination
+// given by atyp, ip and domain, resolving domain with the server's Resolver
+// unless RemoteDNS is set. It returns at least one host.
+func (s *Server) resolve(ctx context.Context, atyp ATYP, ip net.IP, domain string) ([]string, error) {
+	if atyp != DOMAINNAME {
+		return []string{ip.String()}, nil
+	}
+	if s.RemoteDNS {
+		return []string{domain}, nil
+	}
+
+	var resolver Resolver = systemResolver{}
+	if s.Resolver != nil {
+		resolver = s.Resolver
+	}
+	ips, err := resolver.Resolve(ctx, domain)
+	if err != nil {
+		return nil, resolveError(err)
+	}
+	if len(ips) == 0 {
+		return []string{domain}, nil
+	}
+	hosts := make([]string, len(ips))
+	for i, ip := range ips {
+		hosts[i] = ip.String()
+	}
+	return hosts, nil
+}
+
+// resolveError wraps a resolver error in a *ReplyError so the client is
+// replied HostUnreachable, unless the error already maps to a more specific
+// REP such as TTLExpired.
+func resolveError(err error) error {
+	rep := mapErrorToREP(err)
+	if rep == GeneralSOCKSServerFail {
+		rep = HostUnreachable
+	}
+	return &ReplyError{REP: rep, Err: err}
+}
@@ -0,0 +1,95 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// failingResolver fails every lookup with err.
+type failingResolver struct {
+	err error
+}
+
+func (r failingResolver) Resolve(ctx context.Context, host string) ([]net.IP, error) {
+	return nil, r.err
+}
+
+func TestResolverFailureReply(t *testing.T) {
+	s := &Server{Resolver: failingResolver{errors.New("no such host")}}
+	conn := newFakeConn([]byte{V5, 1, NoAuth}, requestBytes(t, CONNECT, "unknown.example:80"))
+	err := s.HandleClient(conn)
+	var replyErr *ReplyError
+	if !errors.As(err, &replyErr) || replyErr.REP != HostUnreachable {
+		t.Errorf("HandleClient: %v, want a HostUnreachable *ReplyError", err)
+	}
+	out := conn.out.Bytes()
+	if len(out) != 12 || out[3] != HostUnreachable {
+		t.Errorf("client read %v, want REP %#x", out, HostUnreachable)
+	}
+}
+
+// staticResolver resolves every name to ips.
+type staticResolver []net.IP
+
+func (r staticResolver) Resolve(ctx context.Context, host string) ([]net.IP, error) {
+	return r, nil
+}
+
+func TestResolverCandidates(t *testing.T) {
+	echo := startEcho(t)
+	_, port, _ := net.SplitHostPort(echo)
+	// nothing listens on 127.0.0.2, so the first candidate refuses
+	dialed := make(chan string, 2)
+	s := &Server{
+		Resolver: staticResolver{net.ParseIP("127.0.0.2"), net.ParseIP("127.0.0.1")},
+		OnDial: func(req *Request, raddr string, err error, dur time.Duration) {
+			dialed <- raddr
+		},
+	}
+	conn := dialNoAuth(t, startServer(t, s))
+	reply := sendRequest(t, conn, CONNECT, net.JoinHostPort("echo.example", port))
+	if reply.REP != Succeeded {
+		t.Fatalf("REP = %#x, want Succeeded", reply.REP)
+	}
+	for _, want := range []string{net.JoinHostPort("127.0.0.2", port), echo} {
+		if got := <-dialed; got != want {
+			t.Errorf("dialed %v, want %v", got, want)
+		}
+	}
+	conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	_, err := io.ReadFull(conn, buf)
+	if err != nil || string(buf) != "ping" {
+		t.Errorf("echo = %q, %v, want %q", buf, err, "ping")
+	}
+}
+
+func TestOnDialDefaultDialer(t *testing.T) {
+	echo := startEcho(t)
+	_, port, _ := net.SplitHostPort(echo)
+	dialed := make(chan string, 8)
+	s := &Server{
+		OnDial: func(req *Request, raddr string, err error, dur time.Duration) {
+			dialed <- raddr
+			if err == nil {
+				close(dialed)
+			}
+		},
+	}
+	conn := dialNoAuth(t, startServer(t, s))
+	reply := sendRequest(t, conn, CONNECT, net.JoinHostPort("localhost", port))
+	if reply.REP != Succeeded {
+		t.Fatalf("REP = %#x, want Succeeded", reply.REP)
+	}
+	// the name is resolved first, so each attempt names an address
+	for raddr := range dialed {
+		host, _, _ := net.SplitHostPort(raddr)
+		if net.ParseIP(host) == nil {
+			t.Errorf("OnDial saw %q, want an IP address", raddr)
+		}
+	}
+}
@@ -1,14 +1,255 @@
 package socks5
 
 import (
-	"log"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
 	"net"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
+// Dialer opens upstream connections on behalf of clients.
+type Dialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// Rules decides whether a request may be served. When Allow returns false
+// the client receives the returned REP, or ConnNotAllow if it is Succeeded.
+// The ConnContext of the client is available from ctx with
+// ConnContextFromContext.
+type Rules interface {
+	Allow(ctx context.Context, req *Request, client net.Addr) (REP, bool)
+}
+
 // Server is a socks5 server
 type Server struct {
+	// Addr is the address to listen on in host:port form, as accepted by
+	// net.Listen. The host may be a hostname or IP literal, and may be
+	// omitted (":1080") to listen on all interfaces. An address of the form
+	// "unix:///path/to/socket" listens on a Unix domain socket instead.
 	Addr string
-	ln   net.Listener
+	// Network is the network to listen on, "tcp" by default. With "unix",
+	// Addr is the path of the socket.
+	Network string
+	// SocketMode, if set, is applied to the socket file when listening on a
+	// Unix domain socket. The file is removed when the listener is closed.
+	SocketMode os.FileMode
+	// Credentials enables username/password authentication when set. It is
+	// then required: a client offering only NoAuth is replied
+	// AuthNoMatchedMethod and closed, and SOCKS4 clients, which cannot
+	// authenticate, are rejected, unless Methods lists NoAuth.
+	Credentials PasswordAuthenticator
+	// GSSAPI enables GSS-API authentication when set, preferred over
+	// username/password. See GSSAPIAuthenticator.
+	GSSAPI Authenticator
+	// Methods, if set, lists the authentication methods the server accepts
+	// in order of preference; the first one the client also offers is
+	// selected. Methods the server is not configured for, such as
+	// AuthPassword without Credentials, are skipped. If nil, GSSAPI and
+	// Credentials are offered when set, and NoAuth only when neither is.
+	Methods []METHOD
+	// Authenticators, if set, replaces Credentials, GSSAPI and Methods: the
+	// server accepts the methods of the listed authenticators, preferring
+	// them in order. An authenticator rejecting a client's credentials
+	// should return an error wrapping ErrAuthFailed.
+	Authenticators []Authenticator
+	// Dialer is used to connect to destinations. If nil, a zero net.Dialer
+	// is used.
+	Dialer Dialer
+	// Router, if set, picks the Dialer for each request, e.g. to reach LAN
+	// destinations directly and everything else through an upstream
+	// proxy. A nil Dialer falls back to the Dialer field.
+	Router func(cc *ConnContext, req *Request) (Dialer, error)
+	// Resolver resolves DOMAINNAME destinations. If nil, the system
+	// resolver is used.
+	Resolver Resolver
+	// RemoteDNS passes DOMAINNAME destinations to the Dialer unresolved,
+	// without consulting the Resolver. Combined with a ChainDialer, this
+	// keeps DNS lookups for CONNECT on the upstream proxy. UDP datagrams are
+	// sent directly and are still resolved locally.
+	RemoteDNS bool
+	// BlockPrivateNetworks refuses destinations in loopback, link-local,
+	// RFC 1918, carrier-grade NAT, unique local, multicast, broadcast,
+	// reserved and NAT64 ranges with ConnNotAllow, checked after resolution
+	// so names resolving to them are refused too.
+	// Destinations a Dialer resolves remotely, as with RemoteDNS and a
+	// ChainDialer, cannot be checked.
+	BlockPrivateNetworks bool
+	// AllowedPorts, if not empty, lists the only destination ports that may
+	// be connected to. Otherwise BlockedPorts lists ports that may not be.
+	// Refused ports are replied ConnNotAllow. Both apply to CONNECT and to
+	// UDP datagrams.
+	AllowedPorts map[uint16]bool
+	BlockedPorts map[uint16]bool
+	// TLSConfig, if set, makes CONNECT speak TLS to the destination with
+	// this config. A Rules implementing TLSRules selects the destinations
+	// that do; otherwise all of them do.
+	TLSConfig *tls.Config
+	// HandshakeTimeout bounds the time from accepting a connection until
+	// its request has been read, so clients that never finish the
+	// handshake are disconnected. Zero means no timeout.
+	HandshakeTimeout time.Duration
+	// DialLocalAddr, if set, is the local address the default dialer
+	// connects to destinations from, e.g. to pick the egress interface of a
+	// multi-homed host. Destinations of the other address family are
+	// replied NetworkUnreachable. It is ignored when Dialer is set.
+	DialLocalAddr *net.TCPAddr
+	// DialTimeout bounds resolving and connecting to a destination, after
+	// which the client is replied TTLExpired. Zero means no timeout, except
+	// for resolving the destination of a UDP datagram, which is bounded by
+	// 5s so one slow lookup cannot stall an association for long.
+	DialTimeout time.Duration
+	// FallbackDelay is how long the default dialer waits for an IPv6
+	// connection to a dual-stack destination before also trying IPv4, as
+	// in RFC 6555. Zero means 300ms; a negative value disables the race.
+	// It only applies when neither Dialer nor Resolver is set, since names
+	// are then resolved by the dialer itself.
+	FallbackDelay time.Duration
+	// OnDial, if set, is called after each attempt to connect to an address
+	// of req's destination, with the address dialed, the error if the
+	// attempt failed and how long it took. A name resolving to several
+	// addresses may be tried several times. So that each attempt can be
+	// reported, the default dialer then resolves names first and tries
+	// their addresses in turn instead of racing them per FallbackDelay.
+	OnDial func(req *Request, raddr string, err error, dur time.Duration)
+	// IdleTimeout closes a relayed connection when neither side has sent
+	// anything for this long. Zero means no timeout.
+	IdleTimeout time.Duration
+	// KeepAlivePeriod, if set, enables TCP keep-alive with this period on
+	// both connections of a relay. Zero leaves the system defaults.
+	KeepAlivePeriod time.Duration
+	// DisableNoDelay turns TCP_NODELAY off on both connections of a relay,
+	// so Nagle's algorithm batches small writes, which suits bulk
+	// transfers. By default TCP_NODELAY is on, keeping interactive
+	// protocols responsive.
+	DisableNoDelay bool
+	// MaxSessionDuration, if set, closes a relayed connection this long
+	// after the client connected, however active it is. IdleTimeout still
+	// applies within that time but never extends past it. UDP associations
+	// end when their control connection is closed at the same limit.
+	MaxSessionDuration time.Duration
+	// PerConnRateLimit, if set, caps the rate of each direction of a relayed
+	// connection to this many bytes per second.
+	PerConnRateLimit int64
+	// OnThroughput, if set, is called every ThroughputInterval while a
+	// connection is relayed, with the bytes relayed so far from and to the
+	// client. It is not called once the relay has ended.
+	OnThroughput func(cc *ConnContext, up, down int64)
+	// ThroughputInterval is how often OnThroughput is called. Zero means
+	// once a second.
+	ThroughputInterval time.Duration
+	// BindPortRange, if set, restricts the ports BIND listens on for the
+	// inbound connection. When every port in it is taken the client is
+	// replied GeneralSOCKSServerFail. By default an ephemeral port is used.
+	BindPortRange PortRange
+	// BindAnyPeer accepts any inbound connection to a BIND listener. By
+	// default only the host given in the BIND request may connect, and
+	// other peers are replied ConnNotAllow; this may be too strict when
+	// the peer is behind NAT.
+	BindAnyPeer bool
+	// AdvertisedBindAddr, if set, is reported in the first BIND reply
+	// instead of the address the listener is bound to, e.g. the public
+	// address of a server behind NAT. A zero Port keeps the listener's
+	// port.
+	AdvertisedBindAddr *net.TCPAddr
+	// UDPOverTCP tunnels UDP associations over the control connection,
+	// each datagram prefixed with its 2-byte length, instead of binding a
+	// UDP socket the client sends to. It helps clients whose egress only
+	// allows TCP.
+	UDPOverTCP bool
+	// AdvertisedUDPAddr, if set, is reported to UDP ASSOCIATE clients as the
+	// relay address instead of the address the relay is bound to, e.g. the
+	// public address of a server behind NAT. A zero Port keeps the bound
+	// port.
+	AdvertisedUDPAddr *net.UDPAddr
+	// EnabledCommands restricts the commands served to those mapped to
+	// true; other requests are replied CMDNotSupported. If nil, all
+	// commands are enabled.
+	EnabledCommands map[CMD]bool
+	// OnRequest, if set, is called with every request before Rules and
+	// may return a modified request, e.g. to redirect its destination,
+	// which is then served instead. A nil request keeps the original. An
+	// error aborts the request; its REP is chosen as for dial errors, so
+	// return a *ReplyError to pick it.
+	OnRequest func(cc *ConnContext, req *Request) (*Request, error)
+	// Rules, if set, is consulted before each request is served.
+	Rules Rules
+	// BufferSize is the size of the buffers used to relay data. If zero,
+	// 32KiB is used.
+	BufferSize int
+	// MaxUDPDatagram is the size of the buffers UDP datagrams are received
+	// into, bounding the datagrams a UDP association relays. Longer
+	// datagrams are truncated, or dropped when tunneled with UDPOverTCP. If
+	// zero, 64KiB is used, enough for any datagram.
+	MaxUDPDatagram int
+	// MaxConnections caps the number of connections served at once, and
+	// MaxConnsPerIP the number served at once for a single client IP. Zero
+	// means no limit. A connection over either limit is not queued: its
+	// request is answered with GeneralSOCKSServerFail (or rejected, for
+	// SOCKS4) and the connection is closed.
+	MaxConnections int
+	MaxConnsPerIP  int
+	// MaxUDPAssociations caps the number of UDP ASSOCIATE requests served
+	// at once, each holding a UDP socket until its control connection is
+	// closed. Requests over it are answered with GeneralSOCKSServerFail.
+	// Zero means no limit.
+	MaxUDPAssociations int
+	// MaxHandlers, if set, caps the number of connections Accept handles at
+	// once, counting those being rejected. Unlike MaxConnections, Accept
+	// then stops accepting until a handler finishes, so further clients
+	// wait in the listen backlog instead of being refused.
+	MaxHandlers int
+	// Strict rejects requests whose RSV field is not 0x00. By default such
+	// requests are served.
+	Strict bool
+	// MaxRequestBytes caps the bytes a client may send before its request
+	// has been read, greeting and authentication included. Clients going
+	// over it are disconnected. Zero means no limit beyond the lengths the
+	// protocol itself allows.
+	MaxRequestBytes int
+	// Metrics, if set, is notified of connections, requests and relayed
+	// bytes.
+	Metrics Metrics
+	// OnClose, if set, is called with the statistics of each client
+	// connection once HandleClient is done with it.
+	OnClose func(stats *ConnStats)
+	// AccountingHook, if set, is called when a client connection is closed
+	// with the bytes relayed from and to the client, to attribute usage to
+	// the user or address in cc.
+	AccountingHook func(cc *ConnContext, up, down int64)
+	// Logger, if set, receives errors encountered while serving clients.
+	// By default nothing is logged.
+	Logger Logger
+	// AccessLog, if set, receives one line per client request once its
+	// connection is closed, with the client, user, command, destination,
+	// REP, bytes relayed each way and duration. Errors still go to Logger,
+	// so the two can be routed to different sinks.
+	AccessLog Logger
+
+	ln net.Listener
+
+	bufOnce sync.Once
+	bufs    *bufferPool
+
+	udpBufOnce sync.Once
+	udpBufs    *bufferPool
+
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+	perIP map[string]int
+	udp   int
+	wg    sync.WaitGroup
+	// stopping is set by Close and Shutdown, after which accepted
+	// connections are closed rather than added to wg.
+	stopping bool
 }
 
 // Listen on server's address & port
@@ -17,50 +258,831 @@ func (s *Server) Listen() error {
 		err error
 	)
 
-	s.ln, err = net.Listen("tcp", s.Addr)
+	network, addr := s.listenAddr()
+	s.ln, err = net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+	if network == "unix" && s.SocketMode != 0 {
+		err = os.Chmod(addr, s.SocketMode)
+		if err != nil {
+			s.ln.Close()
+			return err
+		}
+	}
+	return nil
+}
+
+// listenAddr returns the network and address Listen listens on.
+func (s *Server) listenAddr() (network, addr string) {
+	if strings.HasPrefix(s.Addr, "unix://") {
+		return "unix", strings.TrimPrefix(s.Addr, "unix://")
+	}
+	if s.Network == "" {
+		return "tcp", s.Addr
+	}
+	return s.Network, s.Addr
+}
+
+// ListenTLS listens on the server's address like Listen, but serves
+// clients over TLS using config, which must hold at least one certificate.
+// Clients reach it with a Client whose TLSConfig is set:
+//
+//	client := &socks5.Client{Addr: "proxy.example.com:1080", TLSConfig: &tls.Config{}}
+//	conn, err := client.Dial("tcp", "example.com:80")
+func (s *Server) ListenTLS(config *tls.Config) error {
+	err := s.Listen()
 	if err != nil {
 		return err
 	}
+	s.ln = tls.NewListener(s.ln, config)
 	return nil
 }
 
-func (s *Server) Accept() {
+// BoundAddr returns the address the server is listening on, which reports
+// the actual port when Addr asked for an ephemeral one (":0"). It returns nil
+// before Listen.
+func (s *Server) BoundAddr() net.Addr {
+	if s.ln == nil {
+		return nil
+	}
+	return s.ln.Addr()
+}
+
+// ListenAndServe listens on the server's address and serves incoming
+// connections. It always returns a non-nil error; after Shutdown it is
+// ErrServerClosed.
+func (s *Server) ListenAndServe() error {
+	err := s.Listen()
+	if err != nil {
+		return err
+	}
+	return s.Accept()
+}
+
+// ErrServerClosed is returned by Accept after the listener has been closed.
+var ErrServerClosed = errors.New("socks5: server closed")
+
+// Accept serves incoming connections until the listener is closed, in which
+// case ErrServerClosed is returned. Temporary accept errors are retried with
+// an exponential backoff; any other error is returned as is.
+func (s *Server) Accept() error {
+	var handlers chan struct{}
+	if s.MaxHandlers > 0 {
+		handlers = make(chan struct{}, s.MaxHandlers)
+	}
+	release := func() {
+		if handlers != nil {
+			<-handlers
+		}
+	}
+
+	var delay time.Duration
 	for {
+		if handlers != nil {
+			handlers <- struct{}{}
+		}
 		conn, err := s.ln.Accept()
 		if err != nil {
-			log.Fatal(err)
+			release()
+			if errors.Is(err, net.ErrClosed) {
+				return ErrServerClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else {
+					delay *= 2
+				}
+				if delay > time.Second {
+					delay = time.Second
+				}
+				s.logf("socks5: accept error: %v; retrying in %v", err, delay)
+				time.Sleep(delay)
+				continue
+			}
+			return err
+		}
+		delay = 0
+
+		if !s.addHandler() {
+			release()
+			conn.Close()
+			continue
+		}
+		if !s.trackConn(conn, true) {
+			go func() {
+				defer s.wg.Done()
+				defer release()
+				s.reject(conn)
+			}()
+			continue
+		}
+		go func() {
+			defer s.wg.Done()
+			defer release()
+			defer s.trackConn(conn, false)
+			err := s.HandleClient(conn)
+			if err != nil && !errors.Is(err, ErrClientClosed) {
+				s.logf("socks5: serving %s: %v", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// Close immediately closes the listener, making Accept return
+// ErrServerClosed, and all active connections. It does not wait for their
+// handlers to return; use Shutdown to let connections finish first.
+func (s *Server) Close() error {
+	s.stop()
+	var err error
+	if s.ln != nil {
+		err = s.ln.Close()
+	}
+	s.closeConns()
+	return err
+}
+
+// closeConns closes all active connections.
+func (s *Server) closeConns() {
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+}
+
+// Shutdown gracefully stops the server: it closes the listener and waits
+// for active connections to finish. If ctx expires first, the remaining
+// connections are closed and ctx's error is returned. Connections accepted
+// once Close or Shutdown has been called are closed right away.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.stop()
+	var err error
+	if s.ln != nil {
+		err = s.ln.Close()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return err
+	case <-ctx.Done():
+		s.closeConns()
+		<-done
+		return ctx.Err()
+	}
+}
+
+// stop marks the server as stopping, so that Shutdown's wg.Wait cannot
+// race with a handler being added for a connection accepted meanwhile.
+func (s *Server) stop() {
+	s.mu.Lock()
+	s.stopping = true
+	s.mu.Unlock()
+}
+
+// addHandler adds a connection handler to s.wg, unless the server is
+// stopping, in which case it reports false.
+func (s *Server) addHandler() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopping {
+		return false
+	}
+	s.wg.Add(1)
+	return true
+}
+
+// trackConn adds conn to or removes it from the set of active connections.
+// When adding, it reports false, and does not add conn, if doing so would
+// exceed MaxConnections or MaxConnsPerIP.
+func (s *Server) trackConn(conn net.Conn, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ip := hostOf(conn.RemoteAddr())
+	if !add {
+		delete(s.conns, conn)
+		if s.perIP[ip]--; s.perIP[ip] <= 0 {
+			delete(s.perIP, ip)
+		}
+		return true
+	}
+
+	if s.MaxConnections > 0 && len(s.conns) >= s.MaxConnections {
+		return false
+	}
+	if s.MaxConnsPerIP > 0 && s.perIP[ip] >= s.MaxConnsPerIP {
+		return false
+	}
+	if s.conns == nil {
+		s.conns = make(map[net.Conn]struct{})
+		s.perIP = make(map[string]int)
+	}
+	s.conns[conn] = struct{}{}
+	s.perIP[ip]++
+	return true
+}
+
+// rejectTimeout bounds how long a connection over the limits may take to
+// send the request it is rejected for.
+const rejectTimeout = 5 * time.Second
+
+// reject answers the request of a connection that exceeded the connection
+// limits with a failure reply and closes it. A SOCKS5 client is offered
+// NoAuth, so its request can be read and refused without authenticating it.
+func (s *Server) reject(client net.Conn) {
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(rejectTimeout))
+
+	conn := newBufferedConn(client)
+	ver, err := conn.Peek(1)
+	if err != nil {
+		return
+	}
+
+	switch ver[0] {
+	case V4:
+		_, _, err = HandShake4(conn)
+		if err != nil {
+			return
+		}
+		sendReply4(conn, Rejected4, nil)
+	case V5:
+		_, err = Negotiate(conn, []METHOD{NoAuth})
+		if err != nil {
+			return
+		}
+		_, err = ReadRequest(conn)
+		if err != nil {
+			return
 		}
-		go s.HandleClient(conn)
+		sendStatusReply(conn, GeneralSOCKSServerFail)
 	}
 }
 
-func (s *Server) HandleClient(client net.Conn) error {
-	buf := make([]byte, 255)
+// hostOf returns the host part of addr.
+func hostOf(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// HandleClient serves a single client connection, speaking SOCKS4, SOCKS4a
+// or SOCKS5 depending on the version byte the client opens with.
+//
+// A panic while serving the client is recovered, logged with its stack trace
+// and returned as an error, so it only tears down this connection. A request
+// left unanswered, by a panic or otherwise, is answered with
+// GeneralSOCKSServerFail before the connection is closed.
+func (s *Server) HandleClient(client net.Conn) (err error) {
+	defer client.Close()
+	conn := newBufferedConn(client)
+	cc := &ConnContext{ClientAddr: client.RemoteAddr()}
+	stats := &ConnStats{Client: client.RemoteAddr(), Start: time.Now()}
+	defer func() {
+		stats.Duration = time.Since(stats.Start)
+		stats.Err = err
+		s.logAccess(stats)
+		if s.AccountingHook != nil {
+			s.AccountingHook(cc, stats.BytesUp, stats.BytesDown)
+		}
+		if s.OnClose != nil {
+			s.OnClose(stats)
+		}
+	}()
+	defer func() {
+		if r := recover(); r != nil {
+			s.logf("socks5: panic serving %s: %v\n%s", client.RemoteAddr(), r, debug.Stack())
+			err = fmt.Errorf("socks5: panic: %v", r)
+		}
+	}()
+	// whatever ended the handling of the request, the client gets a reply
+	defer conn.answerPending()
+	s.metrics().OnConnection()
+	ctx := withConnContext(context.Background(), cc)
+
+	s.beginHandshake(conn)
+	ver, err := conn.Peek(1)
+	if err != nil {
+		return clientClosed(err)
+	}
+
+	switch ver[0] {
+	case V4:
+		return s.serve4(ctx, conn, stats)
+	case V5:
+		return s.serve5(ctx, conn, stats)
+	default:
+		return ErrVersionMismatch
+	}
+}
+
+// beginHandshake applies the limits of the handshake phase, which lasts
+// until the client's request has been read, to conn.
+func (s *Server) beginHandshake(conn *bufferedConn) {
+	conn.SetReadLimit(s.MaxRequestBytes)
+	if s.HandshakeTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(s.HandshakeTimeout))
+	}
+}
+
+// endHandshake lifts the limits applied by beginHandshake.
+func (s *Server) endHandshake(conn *bufferedConn) {
+	conn.SetReadLimit(0)
+	if s.HandshakeTimeout > 0 {
+		conn.SetDeadline(time.Time{})
+	}
+}
+
+// serve5 performs the SOCKS5 handshake and executes the client's request.
+func (s *Server) serve5(ctx context.Context, conn *bufferedConn, stats *ConnStats) error {
+	var client net.Conn = conn
+	cc := connContext(ctx)
 
 	//1. handshake
-	n, err := client.Read(buf)
+	auths := s.authenticators()
+	method, err := Negotiate(client, authMethods(auths))
 	if err != nil {
 		return err
 	}
+	cc.Method = method
+	stats.Method = method
+	result, err := authenticatorFor(auths, method).Authenticate(client)
+	if err != nil {
+		// any GSS-API error means the security context was not established
+		if method == AuthGSSAPI || errors.Is(err, ErrAuthFailed) {
+			s.metrics().OnAuthFailure()
+		}
+		return err
+	}
+	if result.Conn != nil {
+		client = result.Conn
+	}
+	cc.AuthUser = result.User
+	stats.AuthUser = result.User
 
 	//2. handle client request
-	request, err := DeserializeRequest(buf[:n])
+	request, err := ReadRequest(client)
+	if err != nil {
+		if errors.Is(err, ErrUnknownATYP) {
+			sendStatusReply(client, ATYPENotSupported)
+		}
+		return err
+	}
+	s.endHandshake(conn)
+	conn.awaitReply(func() { sendStatusReply(client, GeneralSOCKSServerFail) })
+	s.metrics().OnCommand(request.CMD)
+	cc.Command = request.CMD
+	stats.setRequest(request)
+	if s.Strict && request.RSV != 0x00 {
+		stats.Reply = GeneralSOCKSServerFail
+		sendStatusReply(client, GeneralSOCKSServerFail)
+		return ErrInvalidRSV
+	}
+
+	if !s.commandEnabled(request.CMD) {
+		stats.Reply = CMDNotSupported
+		sendStatusReply(client, CMDNotSupported)
+		return ErrUnknownCMD
+	}
+
+	//3. let the request be rewritten and check it against the rules
+	request, err = s.rewrite(ctx, request)
+	if err != nil {
+		stats.Reply = mapErrorToREP(err)
+		sendStatusReply(client, stats.Reply)
+		return err
+	}
+	stats.setRequest(request)
+
+	if rep, ok := s.allow(ctx, request, client.RemoteAddr()); !ok {
+		stats.Reply = rep
+		sendStatusReply(client, rep)
+		return &ReplyError{REP: rep}
+	}
+
+	//4. execute the command
+	switch request.CMD {
+	case CONNECT:
+		return s.handleConnect(ctx, client, request, stats)
+	case BIND:
+		return s.handleBind(ctx, client, request, stats)
+	case UDPASSOCIATE:
+		return s.handleUDPAssociate(ctx, client, request, stats)
+	default:
+		// OnRequest rewrote the command to one not supported
+		stats.Reply = CMDNotSupported
+		sendStatusReply(client, CMDNotSupported)
+		return ErrUnknownCMD
+	}
+}
+
+// handleConnect dials the request's destination and relays data between it
+// and the client.
+func (s *Server) handleConnect(ctx context.Context, client net.Conn, request *Request, stats *ConnStats) error {
+	target, err := s.dialFor(ctx, client, request)
+	if err != nil {
+		rep := mapErrorToREP(err)
+		stats.Reply = rep
+		s.metrics().OnDialError(rep)
+		sendStatusReply(client, rep)
+		return &ReplyError{REP: rep, Err: err}
+	}
+	defer target.Close()
+
+	stats.Reply = Succeeded
+	err = WriteReply(client, boundReply(target.LocalAddr()))
 	if err != nil {
 		return err
 	}
 
-	_ = request
+	return s.relay(ctx, client, target, stats)
+}
+
+// rewrite passes request through s.OnRequest, if set.
+func (s *Server) rewrite(ctx context.Context, request *Request) (*Request, error) {
+	if s.OnRequest == nil {
+		return request, nil
+	}
+	rewritten, err := s.OnRequest(connContext(ctx), request)
+	if err != nil {
+		return nil, err
+	}
+	if rewritten == nil {
+		return request, nil
+	}
+	return rewritten, nil
+}
+
+// commandEnabled reports whether cmd is a command the server implements and
+// is allowed by s.EnabledCommands.
+func (s *Server) commandEnabled(cmd CMD) bool {
+	switch cmd {
+	case CONNECT, BIND, UDPASSOCIATE:
+	default:
+		return false
+	}
+	return s.EnabledCommands == nil || s.EnabledCommands[cmd]
+}
+
+// allow reports whether request is permitted by s.Rules and, if not, the REP
+// to reply with.
+func (s *Server) allow(ctx context.Context, request *Request, client net.Addr) (REP, bool) {
+	if s.Rules == nil {
+		return Succeeded, true
+	}
+	rep, ok := s.Rules.Allow(ctx, request, client)
+	if !ok && rep == Succeeded {
+		rep = ConnNotAllow
+	}
+	return rep, ok
+}
+
+// boundReply returns a Succeeded reply reporting addr as the bound address.
+// An address that is not an IP and port is reported as 0.0.0.0:0.
+func boundReply(addr net.Addr) *Reply {
+	reply, err := NewReplyFromAddr(V5, Succeeded, addr)
+	if err != nil {
+		reply, _ = NewReplyFromAddr(V5, Succeeded, &net.TCPAddr{IP: net.IPv4zero})
+	}
+	return reply
+}
+
+// splitAddr returns the IP and port of addr, or a nil IP if addr does not
+// have any.
+func splitAddr(addr net.Addr) (net.IP, int) {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP, a.Port
+	case *net.UDPAddr:
+		return a.IP, a.Port
+	}
+	if addr == nil {
+		return nil, 0
+	}
+	host, portStr, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil, 0
+	}
+	ip := net.ParseIP(host)
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if ip == nil || err != nil {
+		return nil, 0
+	}
+	return ip, int(port)
+}
+
+// sendStatusReply writes a reply with the given REP and an all-zero IPv4
+// bound address to conn.
+func sendStatusReply(conn net.Conn, rep REP) error {
+	reply := NewReply(V5)
+	reply.REP = rep
+	reply.Atyp = IPV4
+	reply.BNDAddr = net.IPv4zero.To4()
+	return WriteReply(conn, reply)
+}
+
+// dial resolves and connects to the request's destination.
+func (s *Server) dial(ctx context.Context, request *Request) (net.Conn, error) {
+	err := s.checkPort(request.DestPort)
+	if err != nil {
+		return nil, err
+	}
+	if s.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.DialTimeout)
+		defer cancel()
+	}
+
+	dialer := s.Dialer
+	if s.Router != nil {
+		routed, err := s.Router(connContext(ctx), request)
+		if err != nil {
+			return nil, err
+		}
+		if routed != nil {
+			dialer = routed
+		}
+	}
+
+	// the default dialer resolves names itself, racing IPv4 and IPv6
+	// addresses as configured by FallbackDelay, unless OnDial must see
+	// every address tried
+	hosts := []string{request.Domain}
+	if request.Atyp != DOMAINNAME || dialer != nil || s.Resolver != nil || s.OnDial != nil {
+		hosts, err = s.resolve(ctx, request.Atyp, request.DesTAddr, request.Domain)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var local net.IP
+	if dialer == nil {
+		d := &net.Dialer{FallbackDelay: s.FallbackDelay}
+		if s.BlockPrivateNetworks {
+			d.Control = s.controlPrivate
+		}
+		if s.DialLocalAddr != nil {
+			d.LocalAddr = s.DialLocalAddr
+			local = s.DialLocalAddr.IP
+		}
+		dialer = d
+	}
+
+	// try each candidate in turn, reporting the last error if none connects
+	var conn net.Conn
+	port := strconv.Itoa(int(request.DestPort))
+	for _, host := range hosts {
+		err = checkFamily(local, host)
+		if err == nil {
+			err = s.checkPrivate(host)
+		}
+		if err != nil {
+			continue
+		}
+		raddr := net.JoinHostPort(host, port)
+		start := time.Now()
+		conn, err = dialer.DialContext(ctx, "tcp", raddr)
+		if s.OnDial != nil {
+			s.OnDial(request, raddr, err, time.Since(start))
+		}
+		if err == nil || ctx.Err() != nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if s.useTLS(ctx, request) {
+		return s.clientTLS(ctx, conn, request)
+	}
+	return conn, nil
+}
+
+// watchHangup calls hangup if the client's connection is closed, by the
+// client or by the server, before the returned function is called. Bytes
+// the client sends meanwhile stay buffered for the relay. Only a
+// *bufferedConn can be watched; other clients are not.
+func watchHangup(client net.Conn, hangup func()) (stop func()) {
+	bc, ok := client.(*bufferedConn)
+	if !ok {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := bc.Peek(1)
+		if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+			hangup()
+		}
+	}()
+	return func() {
+		// interrupt the peek
+		bc.SetReadDeadline(time.Unix(1, 0))
+		<-done
+		bc.SetReadDeadline(time.Time{})
+	}
+}
+
+// dialFor dials the destination of request like dial, cancelling the dial
+// if the client hangs up in the meantime.
+func (s *Server) dialFor(ctx context.Context, client net.Conn, request *Request) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := watchHangup(client, cancel)
+	conn, err := s.dial(ctx, request)
+	stop()
+	return conn, err
+}
+
+// checkPort returns a *ReplyError with ConnNotAllow if port is refused by
+// s.AllowedPorts or s.BlockedPorts.
+func (s *Server) checkPort(port uint16) error {
+	allowed := !s.BlockedPorts[port]
+	if len(s.AllowedPorts) > 0 {
+		allowed = s.AllowedPorts[port]
+	}
+	if allowed {
+		return nil
+	}
+	return &ReplyError{
+		REP: ConnNotAllow,
+		Err: fmt.Errorf("socks5: destination port %d is not allowed", port),
+	}
+}
+
+// checkFamily returns an error if host is an IP literal of a different
+// family than the local address local. An unspecified local IP matches any
+// family.
+func checkFamily(local net.IP, host string) error {
+	ip := net.ParseIP(host)
+	if ip == nil || local == nil || local.IsUnspecified() {
+		return nil
+	}
+	if (ip.To4() != nil) != (local.To4() != nil) {
+		return &ReplyError{
+			REP: NetworkUnreachable,
+			Err: fmt.Errorf("socks5: cannot reach %s from local address %s", ip, local),
+		}
+	}
 	return nil
 }
 
-func HandShake() {
+// configuredAuthenticators returns the authenticators of the methods of
+// s.Methods the server is able to serve, in the same order.
+func (s *Server) configuredAuthenticators() []Authenticator {
+	var auths []Authenticator
+	for _, method := range s.Methods {
+		switch method {
+		case NoAuth:
+			auths = append(auths, NoAuthAuthenticator{})
+		case AuthGSSAPI:
+			if s.GSSAPI != nil {
+				auths = append(auths, s.GSSAPI)
+			}
+		case AuthPassword:
+			if s.Credentials != nil {
+				auths = append(auths, &UserPassAuthenticator{Credentials: s.Credentials})
+			}
+		}
+	}
+	return auths
+}
 
+// authenticators returns the authenticators of the methods supported by the
+// server, in its order of preference.
+func (s *Server) authenticators() []Authenticator {
+	if s.Authenticators != nil {
+		return s.Authenticators
+	}
+	if s.Methods != nil {
+		return s.configuredAuthenticators()
+	}
+
+	var auths []Authenticator
+	if s.GSSAPI != nil {
+		auths = append(auths, s.GSSAPI)
+	}
+	if s.Credentials != nil {
+		auths = append(auths, &UserPassAuthenticator{Credentials: s.Credentials})
+	}
+	if len(auths) == 0 {
+		auths = append(auths, NoAuthAuthenticator{})
+	}
+	return auths
 }
 
-func HandShake4() {
-	panic("not implement")
+// authMethods returns the methods of auths, in the same order.
+func authMethods(auths []Authenticator) []METHOD {
+	methods := make([]METHOD, 0, len(auths))
+	for _, auth := range auths {
+		methods = append(methods, auth.Method())
+	}
+	if len(methods) == 0 {
+		// Negotiate falls back to NoAuth on an empty list; accept nothing
+		methods = append(methods, AuthNoMatchedMethod)
+	}
+	return methods
 }
 
-func HandShake5() {
+// authenticatorFor returns the first of auths implementing method.
+func authenticatorFor(auths []Authenticator, method METHOD) Authenticator {
+	for _, auth := range auths {
+		if auth.Method() == method {
+			return auth
+		}
+	}
+	return nil
+}
 
+// acceptsNoAuth reports whether the server lets clients in without
+// authenticating.
+func (s *Server) acceptsNoAuth() bool {
+	return authenticatorFor(s.authenticators(), NoAuth) != nil
+}
+
+// ErrClientClosed is returned by Negotiate and HandleClient when the client
+// closed the connection before completing its greeting. Accept does not log
+// it.
+var ErrClientClosed = errors.New("client closed the connection during the handshake")
+
+// clientClosed returns ErrClientClosed if err is an EOF, and err otherwise.
+func clientClosed(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrClientClosed
+	}
+	return err
+}
+
+// ErrNoAcceptableMethods is returned by Negotiate when none of the methods
+// offered by the client is acceptable. By then the 0xFF selection reply has
+// been sent and the connection closed, as RFC 1928 requires.
+var ErrNoAcceptableMethods = errors.New("no acceptable authentication methods")
+
+// ErrNoMethods is returned by Negotiate when the client's greeting lists no
+// methods at all.
+var ErrNoMethods = errors.New("greeting offers no methods")
+
+// Negotiate reads the client's method-selection message from conn, replies
+// with the first of methods, in the server's order of preference, that the
+// client also offered, and returns it. When methods is empty only NoAuth is
+// supported.
+//
+//	+----+----------+----------+
+//	|VER | NMETHODS | METHODS  |
+//	+----+----------+----------+
+//	| 1  |    1     | 1 to 255 |
+//	+----+----------+----------+
+func Negotiate(conn net.Conn, methods []METHOD) (METHOD, error) {
+	if len(methods) == 0 {
+		methods = []METHOD{NoAuth}
+	}
+
+	header := make([]byte, 2)
+	_, err := io.ReadFull(conn, header)
+	if err != nil {
+		return AuthNoMatchedMethod, clientClosed(err)
+	}
+	if header[0] != V5 {
+		return AuthNoMatchedMethod, ErrVersionMismatch
+	}
+
+	if header[1] == 0 {
+		return AuthNoMatchedMethod, ErrNoMethods
+	}
+
+	// read exactly NMETHODS bytes, anything after belongs to what follows
+	offered := make([]byte, header[1])
+	_, err = io.ReadFull(conn, offered)
+	if err != nil {
+		return AuthNoMatchedMethod, clientClosed(err)
+	}
+
+	method := AuthNoMatchedMethod
+	for _, m := range methods {
+		if bytes.IndexByte(offered, m) >= 0 {
+			method = m
+			break
+		}
+	}
+
+	err = writeAll(conn, []byte{V5, method})
+	if err != nil {
+		return AuthNoMatchedMethod, err
+	}
+	if method == AuthNoMatchedMethod {
+		conn.Close()
+		return AuthNoMatchedMethod, ErrNoAcceptableMethods
+	}
+	return method, nil
 }
@@ -0,0 +1,721 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeConn is a net.Conn reading the bytes it was created with and
+// recording what is written to it.
+type fakeConn struct {
+	in  io.Reader
+	out bytes.Buffer
+}
+
+var (
+	fakeServerAddr = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1080}
+	fakeClientAddr = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 50000}
+)
+
+func newFakeConn(in ...[]byte) *fakeConn {
+	return &fakeConn{in: bytes.NewReader(bytes.Join(in, nil))}
+}
+
+func (c *fakeConn) Read(b []byte) (int, error)         { return c.in.Read(b) }
+func (c *fakeConn) Write(b []byte) (int, error)        { return c.out.Write(b) }
+func (c *fakeConn) Close() error                       { return nil }
+func (c *fakeConn) LocalAddr() net.Addr                { return fakeServerAddr }
+func (c *fakeConn) RemoteAddr() net.Addr               { return fakeClientAddr }
+func (c *fakeConn) SetDeadline(t time.Time) error      { return nil }
+func (c *fakeConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *fakeConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// pipeDialer connects every destination to one end of a net.Pipe, sending
+// the other end on peers.
+type pipeDialer struct {
+	addrs chan string
+	peers chan net.Conn
+}
+
+func newPipeDialer() *pipeDialer {
+	return &pipeDialer{addrs: make(chan string, 1), peers: make(chan net.Conn, 1)}
+}
+
+func (d *pipeDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, peer := net.Pipe()
+	d.addrs <- addr
+	d.peers <- peer
+	return conn, nil
+}
+
+// requestBytes returns the serialized request for cmd to hostport.
+func requestBytes(t *testing.T, cmd CMD, hostport string) []byte {
+	t.Helper()
+	request, err := NewRequestFromAddr(V5, cmd, hostport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := SerializeRequest(*request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// startServer serves s on a loopback port until the test ends and returns
+// the address it listens on.
+func startServer(tb testing.TB, s *Server) string {
+	tb.Helper()
+	s.Addr = "127.0.0.1:0"
+	err := s.Listen()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	go s.Accept()
+	tb.Cleanup(func() { s.Close() })
+	return s.BoundAddr().String()
+}
+
+// startEcho runs a TCP server on a loopback port that echoes back what it
+// reads, until the test ends.
+func startEcho(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveEcho(t, ln)
+	return ln.Addr().String()
+}
+
+// serveEcho echoes back what connections accepted by ln send until the test
+// ends.
+func serveEcho(t *testing.T, ln net.Listener) {
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+}
+
+// dialNoAuth connects to the server at addr and negotiates NoAuth.
+func dialNoAuth(t *testing.T, addr string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Write([]byte{V5, 1, NoAuth})
+	if err != nil {
+		t.Fatal(err)
+	}
+	selection := make([]byte, 2)
+	_, err = io.ReadFull(conn, selection)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(selection, []byte{V5, NoAuth}) {
+		t.Fatalf("method selection = %v, want NoAuth", selection)
+	}
+	return conn
+}
+
+// sendRequest writes the request for cmd to hostport on conn and returns
+// the reply.
+func sendRequest(t *testing.T, conn net.Conn, cmd CMD, hostport string) *Reply {
+	t.Helper()
+	_, err := conn.Write(requestBytes(t, cmd, hostport))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := ReadReply(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reply
+}
+
+// chanLogger sends every line logged to it on the channel.
+type chanLogger chan string
+
+func (l chanLogger) Printf(format string, v ...interface{}) {
+	l <- fmt.Sprintf(format, v...)
+}
+
+func TestHandleClientConnect(t *testing.T) {
+	d := newPipeDialer()
+	s := &Server{Dialer: d}
+	conn := newFakeConn([]byte{V5, 1, NoAuth}, requestBytes(t, CONNECT, "10.0.0.1:80"), []byte("hello"))
+
+	got := make(chan string, 1)
+	go func() {
+		peer := <-d.peers
+		defer peer.Close()
+		b := make([]byte, 5)
+		io.ReadFull(peer, b)
+		got <- string(b)
+	}()
+
+	err := s.HandleClient(conn)
+	if err != nil {
+		t.Fatalf("HandleClient: %v", err)
+	}
+	if addr := <-d.addrs; addr != "10.0.0.1:80" {
+		t.Errorf("dialed %s, want 10.0.0.1:80", addr)
+	}
+	if data := <-got; data != "hello" {
+		t.Errorf("destination read %q, want %q", data, "hello")
+	}
+	want := []byte{V5, NoAuth, V5, Succeeded, 0x00, IPV4, 0, 0, 0, 0, 0, 0}
+	if !bytes.Equal(conn.out.Bytes(), want) {
+		t.Errorf("client read %v, want %v", conn.out.Bytes(), want)
+	}
+}
+
+func TestHandleClientErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		server  *Server
+		in      [][]byte
+		want    []byte
+		wantErr error
+	}{
+		{
+			name:    "unsupported version",
+			server:  &Server{},
+			in:      [][]byte{{0x06, 1, NoAuth}},
+			want:    nil,
+			wantErr: ErrVersionMismatch,
+		},
+		{
+			name:    "unsupported ATYP",
+			server:  &Server{},
+			in:      [][]byte{{V5, 1, NoAuth}, {V5, CONNECT, 0x00, 0x05, 0, 80}},
+			want:    []byte{V5, NoAuth, V5, ATYPENotSupported, 0x00, IPV4, 0, 0, 0, 0, 0, 0},
+			wantErr: ErrUnknownATYP,
+		},
+		{
+			name:    "unsupported CMD",
+			server:  &Server{},
+			in:      [][]byte{{V5, 1, NoAuth}, {V5, 0x09, 0x00, IPV4, 10, 0, 0, 1, 0, 80}},
+			want:    []byte{V5, NoAuth, V5, CMDNotSupported, 0x00, IPV4, 0, 0, 0, 0, 0, 0},
+			wantErr: ErrUnknownCMD,
+		},
+		{
+			name:    "auth failure",
+			server:  &Server{Credentials: StaticCredentials{"user": "secret"}},
+			in:      [][]byte{{V5, 1, AuthPassword}, {PasswordAuthVersion, 4}, []byte("user"), {5}, []byte("wrong")},
+			want:    []byte{V5, AuthPassword, PasswordAuthVersion, PasswordAuthFailed},
+			wantErr: ErrAuthFailed,
+		},
+		{
+			name:    "empty username",
+			server:  &Server{Credentials: StaticCredentials{"": "secret"}},
+			in:      [][]byte{{V5, 1, AuthPassword}, {PasswordAuthVersion, 0}, {6}, []byte("secret")},
+			want:    []byte{V5, AuthPassword, PasswordAuthVersion, PasswordAuthFailed},
+			wantErr: ErrAuthFailed,
+		},
+		{
+			name:    "empty password",
+			server:  &Server{Credentials: StaticCredentials{"user": ""}},
+			in:      [][]byte{{V5, 1, AuthPassword}, {PasswordAuthVersion, 4}, []byte("user"), {0}},
+			want:    []byte{V5, AuthPassword, PasswordAuthVersion, PasswordAuthFailed},
+			wantErr: ErrAuthFailed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := newFakeConn(tt.in...)
+			err := tt.server.HandleClient(conn)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("HandleClient: %v, want %v", err, tt.wantErr)
+			}
+			if !bytes.Equal(conn.out.Bytes(), tt.want) {
+				t.Errorf("client read %v, want %v", conn.out.Bytes(), tt.want)
+			}
+		})
+	}
+}
+
+// portRule denies requests to port with rep.
+type portRule struct {
+	port uint16
+	rep  REP
+}
+
+func (r portRule) Allow(ctx context.Context, req *Request, client net.Addr) (REP, bool) {
+	if req.DestPort == r.port {
+		return r.rep, false
+	}
+	return Succeeded, true
+}
+
+func TestRulesReply(t *testing.T) {
+	tests := []struct {
+		rule portRule
+		want REP
+	}{
+		{portRule{25, HostUnreachable}, HostUnreachable},
+		{portRule{25, NetworkUnreachable}, NetworkUnreachable},
+		{portRule{25, ConnectionRefused}, ConnectionRefused},
+		// a denial without a reason is reported as ConnNotAllow
+		{portRule{25, Succeeded}, ConnNotAllow},
+	}
+	for _, tt := range tests {
+		s := &Server{Rules: tt.rule, Dialer: newPipeDialer()}
+		conn := newFakeConn([]byte{V5, 1, NoAuth}, requestBytes(t, CONNECT, "10.0.0.1:25"))
+		err := s.HandleClient(conn)
+		var replyErr *ReplyError
+		if !errors.As(err, &replyErr) || replyErr.REP != tt.want {
+			t.Errorf("rule %v: HandleClient: %v, want a *ReplyError with REP %#x", tt.rule, err, tt.want)
+		}
+		want := []byte{V5, NoAuth, V5, tt.want, 0x00, IPV4, 0, 0, 0, 0, 0, 0}
+		if !bytes.Equal(conn.out.Bytes(), want) {
+			t.Errorf("rule %v: client read %v, want %v", tt.rule, conn.out.Bytes(), want)
+		}
+	}
+
+	// other ports are served
+	d := newPipeDialer()
+	s := &Server{Rules: portRule{25, HostUnreachable}, Dialer: d}
+	conn := newFakeConn([]byte{V5, 1, NoAuth}, requestBytes(t, CONNECT, "10.0.0.1:80"))
+	go func() { (<-d.peers).Close() }()
+	s.HandleClient(conn)
+	if out := conn.out.Bytes(); len(out) < 4 || out[3] != Succeeded {
+		t.Errorf("client read %v, want a Succeeded reply for port 80", out)
+	}
+}
+
+func TestPipelinedGreeting(t *testing.T) {
+	echo := startEcho(t)
+	conn, err := net.Dial("tcp", startServer(t, &Server{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// greeting, request and payload in a single write
+	b := append([]byte{V5, 1, NoAuth}, requestBytes(t, CONNECT, echo)...)
+	_, err = conn.Write(append(b, "ping"...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	selection := make([]byte, 2)
+	_, err = io.ReadFull(conn, selection)
+	if err != nil || !bytes.Equal(selection, []byte{V5, NoAuth}) {
+		t.Fatalf("method selection = %v, %v, want NoAuth", selection, err)
+	}
+	reply, err := ReadReply(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.REP != Succeeded {
+		t.Fatalf("REP = %#x, want Succeeded", reply.REP)
+	}
+	data := make([]byte, 4)
+	_, err = io.ReadFull(conn, data)
+	if err != nil || string(data) != "ping" {
+		t.Errorf("echo = %q, %v, want %q", data, err, "ping")
+	}
+}
+
+func TestNoAuthClientAgainstPasswordServer(t *testing.T) {
+	s := &Server{Credentials: StaticCredentials{"user": "secret"}}
+	conn := newFakeConn([]byte{V5, 1, NoAuth}, requestBytes(t, CONNECT, "10.0.0.1:80"))
+	err := s.HandleClient(conn)
+	if !errors.Is(err, ErrNoAcceptableMethods) {
+		t.Errorf("HandleClient: %v, want %v", err, ErrNoAcceptableMethods)
+	}
+	want := []byte{V5, AuthNoMatchedMethod}
+	if !bytes.Equal(conn.out.Bytes(), want) {
+		t.Errorf("client read %v, want %v", conn.out.Bytes(), want)
+	}
+}
+
+func TestConnectIPv6(t *testing.T) {
+	ln, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 loopback unavailable: %v", err)
+	}
+	serveEcho(t, ln)
+	conn := dialNoAuth(t, startServer(t, &Server{}))
+
+	_, err = conn.Write(requestBytes(t, CONNECT, ln.Addr().String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 4+net.IPv6len+2)
+	_, err = io.ReadFull(conn, reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(reply[:4], []byte{V5, Succeeded, 0x00, IPV6}) {
+		t.Fatalf("reply header = %v, want an IPV6 success", reply[:4])
+	}
+	if ip := net.IP(reply[4:20]); !ip.Equal(net.IPv6loopback) {
+		t.Errorf("BND.ADDR = %v, want ::1", ip)
+	}
+
+	conn.Write([]byte("ping"))
+	b := make([]byte, 4)
+	_, err = io.ReadFull(conn, b)
+	if err != nil || string(b) != "ping" {
+		t.Errorf("echo = %q, %v; want %q", b, err, "ping")
+	}
+}
+
+func TestNoAuthGreeting(t *testing.T) {
+	echo := startEcho(t)
+	addr := startServer(t, &Server{})
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	conn.Write([]byte{0x05, 0x01, 0x00})
+	selection := make([]byte, 2)
+	_, err = io.ReadFull(conn, selection)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(selection, []byte{0x05, 0x00}) {
+		t.Fatalf("method selection = %v, want [5 0]", selection)
+	}
+
+	// no subnegotiation: the request follows right away
+	reply := sendRequest(t, conn, CONNECT, echo)
+	if reply.REP != Succeeded {
+		t.Fatalf("REP = %#x, want Succeeded", reply.REP)
+	}
+	conn.Write([]byte("ping"))
+	b := make([]byte, 4)
+	_, err = io.ReadFull(conn, b)
+	if err != nil || string(b) != "ping" {
+		t.Errorf("echo = %q, %v; want %q", b, err, "ping")
+	}
+}
+
+func TestEnabledCommands(t *testing.T) {
+	s := &Server{EnabledCommands: map[CMD]bool{CONNECT: true}}
+	for _, cmd := range []CMD{BIND, UDPASSOCIATE} {
+		conn := newFakeConn([]byte{V5, 1, NoAuth}, requestBytes(t, cmd, "0.0.0.0:0"))
+		err := s.HandleClient(conn)
+		if !errors.Is(err, ErrUnknownCMD) {
+			t.Errorf("CMD %#x: HandleClient: %v, want %v", cmd, err, ErrUnknownCMD)
+		}
+		want := []byte{V5, NoAuth, V5, CMDNotSupported, 0x00, IPV4, 0, 0, 0, 0, 0, 0}
+		if !bytes.Equal(conn.out.Bytes(), want) {
+			t.Errorf("CMD %#x: client read %v, want %v", cmd, conn.out.Bytes(), want)
+		}
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	logs := make(chanLogger, 1)
+	addr := startServer(t, &Server{HandshakeTimeout: 50 * time.Millisecond, Logger: logs})
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// the client never sends its greeting
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	if err != io.EOF {
+		t.Fatalf("Read: %v, want the server to close the connection", err)
+	}
+	select {
+	case line := <-logs:
+		if !strings.Contains(line, "timeout") {
+			t.Errorf("logged %q, want a timeout", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("timeout was not logged")
+	}
+}
+
+func TestBoundAddr(t *testing.T) {
+	s := &Server{Addr: "127.0.0.1:0"}
+	if addr := s.BoundAddr(); addr != nil {
+		t.Errorf("BoundAddr before Listen = %v, want nil", addr)
+	}
+	err := s.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	addr, ok := s.BoundAddr().(*net.TCPAddr)
+	if !ok || addr.Port == 0 {
+		t.Errorf("BoundAddr = %v, want the port chosen for :0", s.BoundAddr())
+	}
+}
+
+func TestHandleClientRoutesByVersion(t *testing.T) {
+	s := &Server{EnabledCommands: map[CMD]bool{}}
+
+	conn := newFakeConn([]byte{V4, CONNECT, 0, 80, 10, 0, 0, 1, 0x00})
+	s.HandleClient(conn)
+	if want := []byte{0, Rejected4, 0, 0, 0, 0, 0, 0}; !bytes.Equal(conn.out.Bytes(), want) {
+		t.Errorf("SOCKS4 client read %v, want a SOCKS4 reply %v", conn.out.Bytes(), want)
+	}
+
+	conn = newFakeConn([]byte{V5, 1, NoAuth}, requestBytes(t, CONNECT, "10.0.0.1:80"))
+	s.HandleClient(conn)
+	if want := []byte{V5, NoAuth, V5, CMDNotSupported, 0x00, IPV4, 0, 0, 0, 0, 0, 0}; !bytes.Equal(conn.out.Bytes(), want) {
+		t.Errorf("SOCKS5 client read %v, want a SOCKS5 reply %v", conn.out.Bytes(), want)
+	}
+}
+
+func benchmarkAccept(b *testing.B, s *Server) {
+	addr := startServer(b, s)
+	greeting := []byte{V5, 1, NoAuth}
+	b.ReportAllocs()
+	b.SetParallelism(64)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		selection := make([]byte, 2)
+		for pb.Next() {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			conn.Write(greeting)
+			_, err = io.ReadFull(conn, selection)
+			if err != nil {
+				b.Error(err)
+			}
+			// reset rather than leave the port in TIME_WAIT
+			conn.(*net.TCPConn).SetLinger(0)
+			conn.Close()
+		}
+	})
+}
+
+// BenchmarkAccept compares a goroutine per connection against a bounded
+// number of handlers under a flood of short-lived connections, e.g. with
+// -benchtime=10000x.
+func BenchmarkAccept(b *testing.B) {
+	b.Run("unbounded", func(b *testing.B) {
+		benchmarkAccept(b, &Server{})
+	})
+	b.Run("MaxHandlers", func(b *testing.B) {
+		benchmarkAccept(b, &Server{MaxHandlers: 64})
+	})
+}
+
+func TestTruncatedGreeting(t *testing.T) {
+	for _, greeting := range [][]byte{{}, {V5}, {V5, 3}, {V5, 3, NoAuth}} {
+		err := (&Server{}).HandleClient(newFakeConn(greeting))
+		if !errors.Is(err, ErrClientClosed) {
+			t.Errorf("greeting %v: HandleClient: %v, want ErrClientClosed", greeting, err)
+		}
+	}
+
+	logs := make(chanLogger, 2)
+	addr := startServer(t, &Server{Logger: logs})
+	for _, in := range [][]byte{{V5, 3, NoAuth}, {0x06, 1, NoAuth}} {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write(in)
+		conn.(*net.TCPConn).CloseWrite()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		io.Copy(io.Discard, conn)
+		conn.Close()
+	}
+	// only the second client, which sent a bad version, is logged
+	select {
+	case line := <-logs:
+		if !strings.Contains(line, ErrVersionMismatch.Error()) {
+			t.Errorf("logged %q, want only the version mismatch", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("version mismatch was not logged")
+	}
+}
+
+func TestCheckPort(t *testing.T) {
+	tests := []struct {
+		allowed, blocked map[uint16]bool
+		port             uint16
+		want             bool
+	}{
+		{nil, nil, 25, true},
+		{nil, map[uint16]bool{25: true}, 25, false},
+		{nil, map[uint16]bool{25: true}, 80, true},
+		{map[uint16]bool{80: true, 443: true}, nil, 443, true},
+		{map[uint16]bool{80: true, 443: true}, nil, 25, false},
+		// AllowedPorts takes precedence over BlockedPorts
+		{map[uint16]bool{25: true}, map[uint16]bool{25: true}, 25, true},
+		{map[uint16]bool{80: true}, map[uint16]bool{25: true}, 8080, false},
+	}
+	for _, tt := range tests {
+		s := &Server{AllowedPorts: tt.allowed, BlockedPorts: tt.blocked}
+		err := s.checkPort(tt.port)
+		if got := err == nil; got != tt.want {
+			t.Errorf("allowed %v, blocked %v: checkPort(%d) = %v, want allowed %v", tt.allowed, tt.blocked, tt.port, err, tt.want)
+		}
+		if err != nil && mapErrorToREP(err) != ConnNotAllow {
+			t.Errorf("checkPort(%d) REP = %#x, want ConnNotAllow", tt.port, mapErrorToREP(err))
+		}
+	}
+
+	s := &Server{BlockedPorts: map[uint16]bool{25: true}, Dialer: newPipeDialer()}
+	conn := newFakeConn([]byte{V5, 1, NoAuth}, requestBytes(t, CONNECT, "10.0.0.1:25"))
+	s.HandleClient(conn)
+	want := []byte{V5, NoAuth, V5, ConnNotAllow, 0x00, IPV4, 0, 0, 0, 0, 0, 0}
+	if !bytes.Equal(conn.out.Bytes(), want) {
+		t.Errorf("client read %v, want %v", conn.out.Bytes(), want)
+	}
+}
+
+func TestUnknownCommandReply(t *testing.T) {
+	d := newPipeDialer()
+	s := &Server{Dialer: d}
+	conn := newFakeConn([]byte{V5, 1, NoAuth}, []byte{V5, 0x09, 0x00, IPV4, 10, 0, 0, 1, 0, 80})
+	err := s.HandleClient(conn)
+	if !errors.Is(err, ErrUnknownCMD) {
+		t.Errorf("HandleClient: %v, want ErrUnknownCMD", err)
+	}
+	out := conn.out.Bytes()
+	if !bytes.HasPrefix(out, []byte{V5, NoAuth}) {
+		t.Fatalf("client read %v, want the NoAuth selection first", out)
+	}
+	want := []byte{V5, CMDNotSupported, 0x00, IPV4, 0, 0, 0, 0, 0, 0}
+	if reply := out[2:]; !bytes.Equal(reply, want) {
+		t.Errorf("reply = %v (%d bytes), want %v", reply, len(reply), want)
+	}
+	select {
+	case addr := <-d.addrs:
+		t.Errorf("dialed %s for an unknown command", addr)
+	default:
+	}
+}
+
+// watchedDialer reports when a dial starts and, once its context is done,
+// why, without ever connecting.
+type watchedDialer struct {
+	started chan struct{}
+	done    chan error
+}
+
+func (d *watchedDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.started <- struct{}{}
+	<-ctx.Done()
+	d.done <- ctx.Err()
+	return nil, ctx.Err()
+}
+
+func TestClientHangupCancelsDial(t *testing.T) {
+	d := &watchedDialer{started: make(chan struct{}, 1), done: make(chan error, 1)}
+	conn := dialNoAuth(t, startServer(t, &Server{Dialer: d}))
+	_, err := conn.Write(requestBytes(t, CONNECT, "192.0.2.1:80"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-d.started
+	conn.Close()
+	select {
+	case err := <-d.done:
+		if err != context.Canceled {
+			t.Errorf("dial context ended with %v, want context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("dial was not cancelled after the client hung up")
+	}
+}
+
+// dialerFunc adapts a function to the Dialer interface.
+type dialerFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+func (f dialerFunc) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return f(ctx, network, addr)
+}
+
+func TestInternalErrorReply(t *testing.T) {
+	dialers := map[string]Dialer{
+		"error": dialerFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return nil, errors.New("out of sockets")
+		}),
+		"panic": dialerFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+			panic("dialer bug")
+		}),
+	}
+	for name, d := range dialers {
+		conn := newFakeConn([]byte{V5, 1, NoAuth}, requestBytes(t, CONNECT, "10.0.0.1:80"))
+		err := (&Server{Dialer: d}).HandleClient(conn)
+		if err == nil {
+			t.Errorf("%s: HandleClient returned no error", name)
+		}
+		want := []byte{V5, NoAuth, V5, GeneralSOCKSServerFail, 0x00, IPV4, 0, 0, 0, 0, 0, 0}
+		if !bytes.Equal(conn.out.Bytes(), want) {
+			t.Errorf("%s: client read %v, want %v", name, conn.out.Bytes(), want)
+		}
+	}
+}
+
+func TestShutdownWhileAccepting(t *testing.T) {
+	s := &Server{}
+	addr := startServer(t, s)
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				conn, err := net.Dial("tcp", addr)
+				if err != nil {
+					return
+				}
+				conn.Close()
+			}
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := s.Shutdown(ctx)
+	if err != nil {
+		t.Errorf("Shutdown: %v", err)
+	}
+	// no handler may start once Shutdown has returned
+	close(stop)
+	wg.Wait()
+	s.mu.Lock()
+	n := len(s.conns)
+	s.mu.Unlock()
+	if n != 0 {
+		t.Errorf("%d connections still tracked after Shutdown", n)
+	}
+}
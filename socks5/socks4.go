@@ -0,0 +1,158 @@
+package socks5
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+)
+
+// CD values of a SOCKS4 reply
+const (
+	Granted4  uint8 = 0x5a
+	Rejected4 uint8 = 0x5b
+)
+
+// ErrUserIDTooLong is returned by HandShake4 when USERID or the SOCKS4a
+// hostname exceeds 255 bytes.
+var ErrUserIDTooLong = errors.New("null terminated field is too long")
+
+// ErrAuthRequired is returned when a SOCKS4 client, which has no way to
+// authenticate, connects to a server that requires authentication.
+var ErrAuthRequired = errors.New("SOCKS4 client cannot authenticate")
+
+// HandShake4 reads a SOCKS4 or SOCKS4a request from client and returns it
+// along with the USERID. A SOCKS4a request, signalled by a DSTIP of
+// 0.0.0.x with x != 0, is returned with ATYP DOMAINNAME. DSTIP is stored in
+// 16-byte form, as DeserializeRequest stores IPv4 addresses.
+//
+//	+----+----+---------+-------+----------+------+
+//	| VN | CD | DSTPORT | DSTIP |  USERID  | NULL |
+//	+----+----+---------+-------+----------+------+
+//	| 1  | 1  |    2    |   4   | variable |  1   |
+//	+----+----+---------+-------+----------+------+
+func HandShake4(client net.Conn) (*Request, string, error) {
+	header := make([]byte, 8)
+	_, err := io.ReadFull(client, header)
+	if err != nil {
+		return nil, "", err
+	}
+	if header[0] != V4 {
+		return nil, "", ErrVersionMismatch
+	}
+
+	req := NewRequest(V4)
+	req.CMD = header[1]
+	req.DestPort = binary.BigEndian.Uint16(header[2:4])
+	req.Atyp = IPV4
+	req.DesTAddr = copyIP(header[4:8])
+
+	userID, err := readNullTerminated(client)
+	if err != nil {
+		return nil, "", err
+	}
+
+	ip := header[4:8]
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		req.Domain, err = readNullTerminated(client)
+		if err != nil {
+			return nil, "", err
+		}
+		req.Atyp = DOMAINNAME
+		req.DesTAddr = nil
+	}
+	return req, userID, nil
+}
+
+// readNullTerminated reads a string terminated by a NULL byte from r.
+func readNullTerminated(r io.Reader) (string, error) {
+	var field []byte
+	b := make([]byte, 1)
+	for {
+		_, err := io.ReadFull(r, b)
+		if err != nil {
+			return "", err
+		}
+		if b[0] == 0x00 {
+			return string(field), nil
+		}
+		if len(field) == 255 {
+			return "", ErrUserIDTooLong
+		}
+		field = append(field, b[0])
+	}
+}
+
+// sendReply4 writes a SOCKS4 reply with the given CD to client.
+//
+//	+----+----+---------+-------+
+//	| VN | CD | DSTPORT | DSTIP |
+//	+----+----+---------+-------+
+//	| 1  | 1  |    2    |   4   |
+//	+----+----+---------+-------+
+func sendReply4(client net.Conn, cd uint8, addr net.Addr) error {
+	reply := make([]byte, 8)
+	reply[1] = cd
+	if ip, port := splitAddr(addr); ip != nil {
+		binary.BigEndian.PutUint16(reply[2:4], uint16(port))
+		if ip4 := ip.To4(); ip4 != nil {
+			copy(reply[4:], ip4)
+		}
+	}
+	return writeAll(client, reply)
+}
+
+// serve4 handles a SOCKS4 or SOCKS4a client. Only CONNECT is supported, and
+// only when the server accepts NoAuth, since USERID is not a credential.
+func (s *Server) serve4(ctx context.Context, client *bufferedConn, stats *ConnStats) error {
+	request, _, err := HandShake4(client)
+	if err != nil {
+		return err
+	}
+	s.endHandshake(client)
+	client.awaitReply(func() { sendReply4(client, Rejected4, nil) })
+	s.metrics().OnCommand(request.CMD)
+	connContext(ctx).Command = request.CMD
+	stats.setRequest(request)
+	if !s.acceptsNoAuth() {
+		s.metrics().OnAuthFailure()
+		stats.Reply = ConnNotAllow
+		sendReply4(client, Rejected4, nil)
+		return ErrAuthRequired
+	}
+	if request.CMD != CONNECT || !s.commandEnabled(request.CMD) {
+		stats.Reply = CMDNotSupported
+		sendReply4(client, Rejected4, nil)
+		return ErrUnknownCMD
+	}
+
+	request, err = s.rewrite(ctx, request)
+	if err != nil {
+		stats.Reply = mapErrorToREP(err)
+		sendReply4(client, Rejected4, nil)
+		return err
+	}
+	stats.setRequest(request)
+	if rep, ok := s.allow(ctx, request, client.RemoteAddr()); !ok {
+		stats.Reply = rep
+		sendReply4(client, Rejected4, nil)
+		return &ReplyError{REP: rep}
+	}
+
+	target, err := s.dialFor(ctx, client, request)
+	if err != nil {
+		stats.Reply = mapErrorToREP(err)
+		s.metrics().OnDialError(stats.Reply)
+		sendReply4(client, Rejected4, nil)
+		return err
+	}
+	defer target.Close()
+
+	stats.Reply = Succeeded
+	err = sendReply4(client, Granted4, target.LocalAddr())
+	if err != nil {
+		return err
+	}
+	return s.relay(ctx, client, target, stats)
+}
@@ -0,0 +1,88 @@
+package socks5
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestSOCKS4RequiresNoAuth(t *testing.T) {
+	request4 := []byte{V4, CONNECT, 0, 80, 10, 0, 0, 1, 0x00}
+	tests := []struct {
+		name    string
+		server  *Server
+		wantCD  uint8
+		wantErr error
+	}{
+		{"no auth", &Server{}, Granted4, nil},
+		{"password", &Server{Credentials: StaticCredentials{"user": "secret"}}, Rejected4, ErrAuthRequired},
+		{"password or no auth", &Server{
+			Credentials: StaticCredentials{"user": "secret"},
+			Methods:     []METHOD{AuthPassword, NoAuth},
+		}, Granted4, nil},
+		{"authenticators", &Server{Authenticators: []Authenticator{&UserPassAuthenticator{}}}, Rejected4, ErrAuthRequired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newPipeDialer()
+			tt.server.Dialer = d
+			if tt.wantCD == Granted4 {
+				go func() {
+					peer := <-d.peers
+					io.Copy(io.Discard, peer)
+				}()
+			}
+
+			conn := newFakeConn(request4)
+			err := tt.server.HandleClient(conn)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("HandleClient: %v, want %v", err, tt.wantErr)
+			}
+			out := conn.out.Bytes()
+			if len(out) != 8 || out[1] != tt.wantCD {
+				t.Fatalf("client read %v, want CD %#x", out, tt.wantCD)
+			}
+			if tt.wantCD == Rejected4 && !bytes.Equal(out, []byte{0, Rejected4, 0, 0, 0, 0, 0, 0}) {
+				t.Errorf("client read %v, want a bare rejection", out)
+			}
+		})
+	}
+}
+
+func TestHandShake4(t *testing.T) {
+	tests := []struct {
+		name       string
+		in         []byte
+		want       Request
+		wantUserID string
+	}{
+		{
+			name:       "SOCKS4",
+			in:         append([]byte{V4, CONNECT, 0, 80, 10, 0, 0, 1}, "alice\x00"...),
+			want:       Request{Ver: V4, CMD: CONNECT, Atyp: IPV4, DesTAddr: net.ParseIP("10.0.0.1"), DestPort: 80},
+			wantUserID: "alice",
+		},
+		{
+			name: "SOCKS4a",
+			in:   append([]byte{V4, CONNECT, 0x01, 0xbb, 0, 0, 0, 1}, "\x00example.com\x00"...),
+			want: Request{Ver: V4, CMD: CONNECT, Atyp: DOMAINNAME, Domain: "example.com", DestPort: 443},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, userID, err := HandShake4(newFakeConn(tt.in))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("HandShake4 = %+v, want %+v", *got, tt.want)
+			}
+			if userID != tt.wantUserID {
+				t.Errorf("USERID = %q, want %q", userID, tt.wantUserID)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+// Package socks5test provides a socks5 server for end-to-end tests, in the
+// spirit of net/http/httptest.
+//
+//	proxy := socks5test.NewServer()
+//	defer proxy.Close()
+//
+//	backend := httptest.NewServer(handler)
+//	defer backend.Close()
+//
+//	client := &http.Client{Transport: &http.Transport{DialContext: proxy.Client().DialContext}}
+//	resp, err := client.Get(backend.URL)
+package socks5test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/haochen233/proxy/socks5"
+)
+
+// Server is a socks5 server listening on a loopback port, without
+// authentication. It only connects to loopback destinations.
+type Server struct {
+	// Addr is the address the server listens on, in host:port form.
+	Addr string
+	// Config is the server being run. It may be inspected but should not
+	// be modified once NewServer returns.
+	Config *socks5.Server
+}
+
+// NewServer starts and returns a new Server. The caller should call Close
+// when finished, to shut it down.
+func NewServer() *Server {
+	s := &socks5.Server{
+		Addr:   "127.0.0.1:0",
+		Dialer: loopbackDialer{},
+	}
+	err := s.Listen()
+	if err != nil {
+		panic(fmt.Sprintf("socks5test: failed to listen on a port: %v", err))
+	}
+	go s.Accept()
+	return &Server{Addr: s.BoundAddr().String(), Config: s}
+}
+
+// Client returns a Client that connects through s.
+func (s *Server) Client() *socks5.Client {
+	return &socks5.Client{Addr: s.Addr}
+}
+
+// Close shuts down the server and closes the connections it still serves.
+func (s *Server) Close() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	s.Config.Shutdown(ctx)
+}
+
+// loopbackDialer refuses to connect anywhere but loopback addresses.
+type loopbackDialer struct{}
+
+func (loopbackDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return nil, &socks5.ReplyError{
+			REP: socks5.ConnNotAllow,
+			Err: fmt.Errorf("socks5test: refusing to dial non-loopback address %s", addr),
+		}
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, network, addr)
+}
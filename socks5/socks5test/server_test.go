@@ -0,0 +1,43 @@
+package socks5test
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestServer(t *testing.T) {
+	proxy := NewServer()
+	defer proxy.Close()
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello through the proxy")
+	}))
+	defer backend.Close()
+
+	client := &http.Client{Transport: &http.Transport{DialContext: proxy.Client().DialContext}}
+	resp, err := client.Get(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "hello through the proxy" {
+		t.Errorf("body = %q, want %q", body, "hello through the proxy")
+	}
+}
+
+func TestServerRefusesNonLoopback(t *testing.T) {
+	proxy := NewServer()
+	defer proxy.Close()
+
+	_, err := proxy.Client().Dial("tcp", "192.0.2.1:80")
+	if err == nil {
+		t.Fatal("Dial to a non-loopback address succeeded")
+	}
+}
@@ -0,0 +1,53 @@
+package socks5
+
+import (
+	"net"
+	"strconv"
+	"time"
+)
+
+// ConnStats describes a client connection served by HandleClient. It is
+// passed to Server.OnClose once the connection is done.
+type ConnStats struct {
+	// Client is the client's remote address.
+	Client net.Addr
+	// Start is the time HandleClient started serving the client.
+	Start time.Time
+	// Duration is how long the client was served.
+	Duration time.Duration
+	// Method and AuthUser are the authentication method negotiated and
+	// the user authenticated, as in ConnContext.
+	Method   METHOD
+	AuthUser string
+	// Command is the command the client requested. It is zero if the
+	// connection ended before a request was read.
+	Command CMD
+	// Destination is the host:port the request was for, after OnRequest.
+	Destination string
+	// Reply is the REP the request was answered with. SOCKS4 replies are
+	// reported by their SOCKS5 equivalent.
+	Reply REP
+	// BytesUp and BytesDown count the payload bytes relayed from the client
+	// and to the client.
+	BytesUp   int64
+	BytesDown int64
+	// Err is the error HandleClient returned, if any.
+	Err error
+}
+
+// setRequest records request as the one being served. Until a reply is
+// recorded, the request counts as failed.
+func (st *ConnStats) setRequest(request *Request) {
+	st.Command = request.CMD
+	st.Destination = requestDest(request)
+	st.Reply = GeneralSOCKSServerFail
+}
+
+// requestDest returns the host:port request is for.
+func requestDest(request *Request) string {
+	host := request.Domain
+	if request.Atyp != DOMAINNAME {
+		host = request.DesTAddr.String()
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(request.DestPort)))
+}
@@ -0,0 +1,92 @@
+package socks5
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// passwordGreeting returns the greeting and RFC 1929 subnegotiation of a
+// client authenticating as user with password.
+func passwordGreeting(user, password string) []byte {
+	b := []byte{V5, 1, AuthPassword, PasswordAuthVersion, byte(len(user))}
+	b = append(b, user...)
+	b = append(b, byte(len(password)))
+	return append(b, password...)
+}
+
+func TestStatsReportAuth(t *testing.T) {
+	var cc *ConnContext
+	var stats *ConnStats
+	d := newPipeDialer()
+	s := &Server{
+		Credentials: StaticCredentials{"alice": "secret"},
+		Dialer:      d,
+		Router: func(c *ConnContext, req *Request) (Dialer, error) {
+			copied := *c
+			cc = &copied
+			return nil, nil
+		},
+		OnClose: func(st *ConnStats) { stats = st },
+	}
+	conn := newFakeConn(passwordGreeting("alice", "secret"), requestBytes(t, CONNECT, "10.0.0.1:80"))
+	go func() { (<-d.peers).Close() }()
+	err := s.HandleClient(conn)
+	if err != nil {
+		t.Fatalf("HandleClient: %v", err)
+	}
+	if cc == nil || cc.Method != AuthPassword || cc.AuthUser != "alice" {
+		t.Errorf("ConnContext = %+v, want AuthPassword for alice", cc)
+	}
+	if stats == nil || stats.Method != AuthPassword || stats.AuthUser != "alice" {
+		t.Errorf("ConnStats = %+v, want AuthPassword for alice", stats)
+	}
+}
+
+func TestAccountingHook(t *testing.T) {
+	type usage struct {
+		user     string
+		up, down int64
+	}
+	var got []usage
+	d := newPipeDialer()
+	s := &Server{
+		Credentials: StaticCredentials{"alice": "secret"},
+		Dialer:      d,
+		AccountingHook: func(cc *ConnContext, up, down int64) {
+			got = append(got, usage{cc.AuthUser, up, down})
+		},
+	}
+	// the client hangs up only once the destination has answered
+	pr, pw := io.Pipe()
+	handshake := append(passwordGreeting("alice", "secret"), requestBytes(t, CONNECT, "10.0.0.1:80")...)
+	conn := &fakeConn{in: io.MultiReader(bytes.NewReader(handshake), strings.NewReader("hello"), pr)}
+	go func() {
+		peer := <-d.peers
+		defer peer.Close()
+		io.ReadFull(peer, make([]byte, 5))
+		peer.Write([]byte("world!"))
+		pw.Close()
+	}()
+	s.HandleClient(conn)
+	want := usage{"alice", 5, 6}
+	if len(got) != 1 || got[0] != want {
+		t.Errorf("AccountingHook calls = %+v, want one call with %+v", got, want)
+	}
+}
+
+func TestStatsReportStrictReply(t *testing.T) {
+	var stats *ConnStats
+	s := &Server{Strict: true, OnClose: func(st *ConnStats) { stats = st }}
+	request := requestBytes(t, CONNECT, "10.0.0.1:80")
+	request[2] = 0x01 // RSV
+	err := s.HandleClient(newFakeConn([]byte{V5, 1, NoAuth}, request))
+	if !errors.Is(err, ErrInvalidRSV) {
+		t.Fatalf("HandleClient: %v, want %v", err, ErrInvalidRSV)
+	}
+	if stats == nil || stats.Reply != GeneralSOCKSServerFail {
+		t.Errorf("ConnStats = %+v, want Reply GeneralSOCKSServerFail", stats)
+	}
+}
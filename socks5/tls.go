@@ -0,0 +1,48 @@
+package socks5
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+)
+
+// TLSRules is a Rules that also chooses, per request, whether the upstream
+// connection is wrapped in TLS when Server.TLSConfig is set.
+type TLSRules interface {
+	Rules
+	UseTLS(ctx context.Context, req *Request) bool
+}
+
+// useTLS reports whether the upstream connection for request must speak
+// TLS. Without a TLSRules every destination does once TLSConfig is set.
+func (s *Server) useTLS(ctx context.Context, request *Request) bool {
+	if s.TLSConfig == nil {
+		return false
+	}
+	if rules, ok := s.Rules.(TLSRules); ok {
+		return rules.UseTLS(ctx, request)
+	}
+	return true
+}
+
+// clientTLS performs a TLS client handshake on conn, verifying the
+// destination of request unless the config names a server itself. The
+// handshake is abandoned once ctx is done.
+func (s *Server) clientTLS(ctx context.Context, conn net.Conn, request *Request) (net.Conn, error) {
+	config := s.TLSConfig
+	if config.ServerName == "" {
+		config = config.Clone()
+		config.ServerName = request.Domain
+		if request.Atyp != DOMAINNAME {
+			config.ServerName = request.DesTAddr.String()
+		}
+	}
+
+	tlsConn := tls.Client(conn, config)
+	err := tlsConn.HandshakeContext(ctx)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
@@ -0,0 +1,45 @@
+package socks5
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestUpstreamTLSHandshakeCancel(t *testing.T) {
+	// an upstream that accepts but never answers the handshake
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	closed := make(chan *ConnStats, 1)
+	s := &Server{TLSConfig: &tls.Config{}, OnClose: func(st *ConnStats) { closed <- st }}
+	conn := dialNoAuth(t, startServer(t, s))
+	_, err = conn.Write(requestBytes(t, CONNECT, ln.Addr().String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// hang up while the handshake is under way
+	time.Sleep(100 * time.Millisecond)
+	conn.Close()
+	select {
+	case st := <-closed:
+		if st.Err == nil {
+			t.Error("HandleClient succeeded against a silent TLS upstream")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the TLS handshake was not abandoned when the client hung up")
+	}
+}
@@ -0,0 +1,402 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+// UDPHeader is the header prepended to every datagram relayed through a UDP
+// association.
+//
+//	+----+------+------+----------+----------+----------+
+//	|RSV | FRAG | ATYP | DST.ADDR | DST.PORT |   DATA   |
+//	+----+------+------+----------+----------+----------+
+//	| 2  |  1   |  1   | Variable |    2     | Variable |
+//	+----+------+------+----------+----------+----------+
+type UDPHeader struct {
+	RSV  uint16
+	FRAG uint8
+	Atyp ATYP
+	// DstAddr holds the address when ATYP is IPV4 or IPV6. Parsed IPv4
+	// addresses are stored in 16-byte form, as returned by net.ParseIP.
+	DstAddr net.IP
+	// Domain holds the address when ATYP is DOMAINNAME
+	Domain  string
+	DstPort uint16
+}
+
+// ErrUDPFragment is returned by DeserializeUDPRequest when a datagram has a
+// non-zero FRAG field; fragmentation is not supported.
+var ErrUDPFragment = errors.New("udp fragmentation is not supported")
+
+// ErrUDPLength is returned by DeserializeUDPRequest when a datagram is too
+// short to hold its header.
+var ErrUDPLength = errors.New("datagram is too short")
+
+// maxUDPDatagram is the size of the buffers UDP datagrams are received into
+// when Server.MaxUDPDatagram is not set, large enough for any datagram.
+const maxUDPDatagram = 64 * 1024
+
+// udpBuffers returns the pool of UDP receive buffers sized by
+// s.MaxUDPDatagram.
+func (s *Server) udpBuffers() *bufferPool {
+	s.udpBufOnce.Do(func() {
+		size := s.MaxUDPDatagram
+		if size <= 0 {
+			size = maxUDPDatagram
+		}
+		s.udpBufs = newBufferPool(size)
+	})
+	return s.udpBufs
+}
+
+// SerializeUDPRequest serializes header followed by the payload data.
+func SerializeUDPRequest(header UDPHeader, data []byte) ([]byte, error) {
+	var content bytes.Buffer
+	rsv := make([]byte, 2)
+	binary.BigEndian.PutUint16(rsv, header.RSV)
+	content.Write(rsv)
+	content.WriteByte(header.FRAG)
+	content.WriteByte(header.Atyp)
+	if header.Atyp == DOMAINNAME {
+		if len(header.Domain) == 0 || len(header.Domain) > 255 {
+			return nil, errors.New("invalid domain length")
+		}
+		content.WriteByte(byte(len(header.Domain)))
+		content.WriteString(header.Domain)
+	} else {
+		ip, err := addrBytes(header.Atyp, header.DstAddr)
+		if err != nil {
+			return nil, err
+		}
+		content.Write(ip)
+	}
+
+	port := make([]byte, 2)
+	binary.BigEndian.PutUint16(port, header.DstPort)
+	content.Write(port)
+	content.Write(data)
+	return content.Bytes(), nil
+}
+
+// DeserializeUDPRequest parses the header at the start of content. It
+// returns the header and the offset at which the payload starts.
+func DeserializeUDPRequest(content []byte) (*UDPHeader, int, error) {
+	if len(content) < 4 {
+		return nil, 0, ErrUDPLength
+	}
+
+	header := new(UDPHeader)
+	header.RSV = binary.BigEndian.Uint16(content[0:2])
+	header.FRAG = content[2]
+	header.Atyp = content[3]
+	if header.FRAG != 0 {
+		return nil, 0, ErrUDPFragment
+	}
+
+	var offset int
+	switch header.Atyp {
+	case IPV4:
+		offset = 4 + net.IPv4len
+		if len(content) < offset+2 {
+			return nil, 0, ErrUDPLength
+		}
+		header.DstAddr = copyIP(content[4:offset])
+	case IPV6:
+		offset = 4 + net.IPv6len
+		if len(content) < offset+2 {
+			return nil, 0, ErrUDPLength
+		}
+		header.DstAddr = copyIP(content[4:offset])
+	case DOMAINNAME:
+		if len(content) < 5 {
+			return nil, 0, ErrUDPLength
+		}
+		if content[4] == 0 {
+			return nil, 0, ErrEmptyDomain
+		}
+		offset = 5 + int(content[4])
+		if len(content) < offset+2 {
+			return nil, 0, ErrUDPLength
+		}
+		header.Domain = string(content[5:offset])
+	default:
+		return nil, 0, ErrUnknownATYP
+	}
+	header.DstPort = binary.BigEndian.Uint16(content[offset:])
+	return header, offset + 2, nil
+}
+
+// handleUDPAssociate binds a UDP relay for the client and forwards datagrams
+// until the control connection is closed.
+func (s *Server) handleUDPAssociate(ctx context.Context, client net.Conn, request *Request, stats *ConnStats) error {
+	if !s.trackUDPAssociation(true) {
+		sendStatusReply(client, GeneralSOCKSServerFail)
+		return errors.New("socks5: too many UDP associations")
+	}
+	defer s.trackUDPAssociation(false)
+	// an association lasts as long as its control connection
+	if s.MaxSessionDuration > 0 {
+		client.SetDeadline(stats.Start.Add(s.MaxSessionDuration))
+	}
+
+	if s.UDPOverTCP {
+		return s.handleUDPOverTCP(ctx, client, stats)
+	}
+	// datagrams are matched to the client by IP, which a client on a Unix
+	// domain socket does not have
+	clientIP, _ := splitAddr(client.RemoteAddr())
+	host, _, err := net.SplitHostPort(client.LocalAddr().String())
+	if err != nil || clientIP == nil {
+		sendStatusReply(client, GeneralSOCKSServerFail)
+		return errors.New("socks5: UDP ASSOCIATE requires a TCP control connection")
+	}
+
+	relayConn, err := net.ListenPacket("udp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		sendStatusReply(client, GeneralSOCKSServerFail)
+		return err
+	}
+	defer relayConn.Close()
+
+	stats.Reply = Succeeded
+	err = WriteReply(client, boundReply(s.advertisedUDPAddr(relayConn.LocalAddr())))
+	if err != nil {
+		return err
+	}
+
+	// the association ends when the control connection does
+	go func() {
+		io.Copy(ioutil.Discard, client)
+		relayConn.Close()
+	}()
+
+	return s.relayUDP(ctx, relayConn, clientIP, stats)
+}
+
+// advertisedUDPAddr returns the address to report for a UDP relay bound to
+// local, applying s.AdvertisedUDPAddr.
+func (s *Server) advertisedUDPAddr(local net.Addr) net.Addr {
+	if s.AdvertisedUDPAddr == nil {
+		return local
+	}
+	addr := *s.AdvertisedUDPAddr
+	if addr.Port == 0 {
+		_, addr.Port = splitAddr(local)
+	}
+	return &addr
+}
+
+// relayUDP forwards datagrams between the client at clientIP and remote
+// hosts until conn is closed, adding the payload bytes relayed to stats.
+func (s *Server) relayUDP(ctx context.Context, conn net.PacketConn, clientIP net.IP, stats *ConnStats) error {
+	var clientAddr *net.UDPAddr
+	buf := s.udpBuffers().Get()
+	defer s.udpBuffers().Put(buf)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		src := addr.(*net.UDPAddr)
+
+		if src.IP.Equal(clientIP) && (clientAddr == nil || src.Port == clientAddr.Port) {
+			clientAddr = src
+			header, offset, err := DeserializeUDPRequest(buf[:n])
+			if err != nil {
+				continue
+			}
+			data := buf[offset:n]
+			dst, err := s.resolveUDP(ctx, header)
+			if err != nil {
+				continue
+			}
+			conn.WriteTo(data, dst)
+			stats.BytesUp += int64(len(data))
+			s.metrics().OnBytesRelayed(int64(len(data)))
+			continue
+		}
+
+		if clientAddr == nil {
+			continue
+		}
+		content, err := SerializeUDPRequest(newUDPHeader(src), buf[:n])
+		if err != nil {
+			continue
+		}
+		conn.WriteTo(content, clientAddr)
+		stats.BytesDown += int64(n)
+		s.metrics().OnBytesRelayed(int64(n))
+	}
+}
+
+// newUDPHeader returns the header announcing a datagram received from addr.
+func newUDPHeader(addr *net.UDPAddr) UDPHeader {
+	header := UDPHeader{DstPort: uint16(addr.Port)}
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		header.Atyp = IPV4
+		header.DstAddr = ip4
+	} else {
+		header.Atyp = IPV6
+		header.DstAddr = addr.IP
+	}
+	return header
+}
+
+// udpResolveTimeout bounds resolving the destination of a UDP datagram when
+// DialTimeout is not set, since the association relays nothing meanwhile.
+const udpResolveTimeout = 5 * time.Second
+
+// resolveUDP returns the destination of the datagram described by header.
+func (s *Server) resolveUDP(ctx context.Context, header *UDPHeader) (*net.UDPAddr, error) {
+	err := s.checkPort(header.DstPort)
+	if err != nil {
+		return nil, err
+	}
+	timeout := s.DialTimeout
+	if timeout <= 0 {
+		timeout = udpResolveTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	hosts, err := s.resolve(ctx, header.Atyp, header.DstAddr, header.Domain)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(hosts[0])
+	if ip == nil {
+		// RemoteDNS leaves the name to resolve here
+		ips, err := net.DefaultResolver.LookupIP(ctx, "ip", hosts[0])
+		if err != nil {
+			return nil, err
+		}
+		ip = ips[0]
+	}
+	addr := &net.UDPAddr{IP: ip, Port: int(header.DstPort)}
+	err = s.checkPrivate(addr.IP.String())
+	if err != nil {
+		return nil, err
+	}
+	return addr, nil
+}
+
+// trackUDPAssociation counts an association in or out. When counting in, it
+// reports false, and does not count it, if doing so would exceed
+// MaxUDPAssociations.
+func (s *Server) trackUDPAssociation(add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !add {
+		s.udp--
+		return true
+	}
+	if s.MaxUDPAssociations > 0 && s.udp >= s.MaxUDPAssociations {
+		return false
+	}
+	s.udp++
+	return true
+}
+
+// handleUDPOverTCP serves a UDP association whose datagrams are tunneled
+// over the control connection instead of a separate UDP socket. Each
+// datagram, including its UDP request header, is prefixed with its length
+// as a 2-byte big-endian integer in both directions.
+func (s *Server) handleUDPOverTCP(ctx context.Context, client net.Conn, stats *ConnStats) error {
+	egress, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		sendStatusReply(client, GeneralSOCKSServerFail)
+		return err
+	}
+	defer egress.Close()
+
+	stats.Reply = Succeeded
+	err = sendStatusReply(client, Succeeded)
+	if err != nil {
+		return err
+	}
+
+	// down is owned by the goroutine until done is closed
+	var down int64
+	done := make(chan struct{})
+	defer func() {
+		egress.Close()
+		client.Close()
+		<-done
+		stats.BytesDown += down
+	}()
+	go func() {
+		defer close(done)
+		buf := s.udpBuffers().Get()
+		defer s.udpBuffers().Put(buf)
+		frame := make([]byte, 2, 2+len(buf))
+		for {
+			n, addr, err := egress.ReadFrom(buf)
+			if err != nil {
+				client.Close()
+				return
+			}
+			content, err := SerializeUDPRequest(newUDPHeader(addr.(*net.UDPAddr)), buf[:n])
+			if err != nil || len(content) > 0xffff {
+				continue
+			}
+			binary.BigEndian.PutUint16(frame, uint16(len(content)))
+			err = writeAll(client, append(frame[:2], content...))
+			if err != nil {
+				return
+			}
+			down += int64(n)
+			s.metrics().OnBytesRelayed(int64(n))
+		}
+	}()
+
+	length := make([]byte, 2)
+	buf := s.udpBuffers().Get()
+	defer s.udpBuffers().Put(buf)
+	for {
+		_, err = io.ReadFull(client, length)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		n := int(binary.BigEndian.Uint16(length))
+		if n > len(buf) {
+			// too long for MaxUDPDatagram: skip the frame
+			_, err = io.CopyN(ioutil.Discard, client, int64(n))
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		content := buf[:n]
+		_, err = io.ReadFull(client, content)
+		if err != nil {
+			return err
+		}
+
+		header, offset, err := DeserializeUDPRequest(content)
+		if err != nil {
+			continue
+		}
+		data := content[offset:]
+		dst, err := s.resolveUDP(ctx, header)
+		if err != nil {
+			continue
+		}
+		egress.WriteTo(data, dst)
+		stats.BytesUp += int64(len(data))
+		s.metrics().OnBytesRelayed(int64(len(data)))
+	}
+}
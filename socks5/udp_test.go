@@ -0,0 +1,332 @@
+package socks5
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUDPMaxSessionDuration(t *testing.T) {
+	s := &Server{MaxSessionDuration: 100 * time.Millisecond}
+	conn := dialNoAuth(t, startServer(t, s))
+	start := time.Now()
+	reply := sendRequest(t, conn, UDPASSOCIATE, "0.0.0.0:0")
+	if reply.REP != Succeeded {
+		t.Fatalf("REP = %#x, want Succeeded", reply.REP)
+	}
+	// the server closes the control connection, ending the association
+	_, err := conn.Read(make([]byte, 1))
+	if err != io.EOF {
+		t.Fatalf("Read = %v, want EOF", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("association lasted %v, want about %v", elapsed, s.MaxSessionDuration)
+	}
+}
+
+// BenchmarkRelayUDP measures the allocations of relaying one datagram from
+// the client to its destination.
+func BenchmarkRelayUDP(b *testing.B) {
+	relayConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer relayConn.Close()
+	dst, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer dst.Close()
+	client, err := net.DialUDP("udp", nil, relayConn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer client.Close()
+
+	s := &Server{}
+	go s.relayUDP(context.Background(), relayConn, net.IPv4(127, 0, 0, 1), &ConnStats{})
+
+	datagram, err := SerializeUDPRequest(newUDPHeader(dst.LocalAddr().(*net.UDPAddr)), make([]byte, 1024))
+	if err != nil {
+		b.Fatal(err)
+	}
+	buf := make([]byte, maxUDPDatagram)
+	b.ReportAllocs()
+	b.SetBytes(1024)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err = client.Write(datagram)
+		if err != nil {
+			b.Fatal(err)
+		}
+		_, err = dst.Read(buf)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestMaxUDPAssociations(t *testing.T) {
+	const max = 2
+	addr := startServer(t, &Server{MaxUDPAssociations: max})
+	var conns []net.Conn
+	for i := 0; i < max; i++ {
+		conn := dialNoAuth(t, addr)
+		if reply := sendRequest(t, conn, UDPASSOCIATE, "0.0.0.0:0"); reply.REP != Succeeded {
+			t.Fatalf("association %d: REP = %#x, want Succeeded", i+1, reply.REP)
+		}
+		conns = append(conns, conn)
+	}
+	conn := dialNoAuth(t, addr)
+	if reply := sendRequest(t, conn, UDPASSOCIATE, "0.0.0.0:0"); reply.REP != GeneralSOCKSServerFail {
+		t.Fatalf("association %d: REP = %#x, want GeneralSOCKSServerFail", max+1, reply.REP)
+	}
+
+	// closing a control connection frees its slot
+	conns[0].Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn := dialNoAuth(t, addr)
+		reply := sendRequest(t, conn, UDPASSOCIATE, "0.0.0.0:0")
+		conn.Close()
+		if reply.REP == Succeeded {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("slot was not reclaimed after the control connection closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// startUDPEcho runs a UDP server on a loopback port that echoes back every
+// datagram it receives, until the test ends.
+func startUDPEcho(t *testing.T) *net.UDPAddr {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, maxUDPDatagram)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(buf[:n], addr)
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+// associate opens a UDP association on a server running s and returns a UDP
+// socket connected to its relay.
+func associate(t *testing.T, s *Server) *net.UDPConn {
+	t.Helper()
+	conn := dialNoAuth(t, startServer(t, s))
+	reply := sendRequest(t, conn, UDPASSOCIATE, "0.0.0.0:0")
+	if reply.REP != Succeeded {
+		t.Fatalf("REP = %#x, want Succeeded", reply.REP)
+	}
+	relay := &net.UDPAddr{IP: reply.BNDAddr, Port: int(reply.BNDPort)}
+	if relay.IP.IsUnspecified() {
+		relay.IP = net.IPv4(127, 0, 0, 1)
+	}
+	client, err := net.DialUDP("udp", nil, relay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	return client
+}
+
+// roundTripUDP sends payload to dst through the relay client is connected to,
+// and checks the reply comes back from dst with the same payload.
+func roundTripUDP(t *testing.T, client *net.UDPConn, dst *net.UDPAddr, payload string) {
+	t.Helper()
+	datagram, err := SerializeUDPRequest(newUDPHeader(dst), []byte(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Write(datagram)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, maxUDPDatagram)
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, offset, err := DeserializeUDPRequest(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !header.DstAddr.Equal(dst.IP) || int(header.DstPort) != dst.Port {
+		t.Errorf("reply from %v:%d, want %v", header.DstAddr, header.DstPort, dst)
+	}
+	if got := string(buf[offset:n]); got != payload {
+		t.Errorf("reply payload = %q, want %q", got, payload)
+	}
+}
+
+func TestUDPAssociateRoundTrip(t *testing.T) {
+	client := associate(t, &Server{})
+	roundTripUDP(t, client, startUDPEcho(t), "ping")
+}
+
+// blockingResolver blocks until its context is done.
+type blockingResolver struct{}
+
+func (blockingResolver) Resolve(ctx context.Context, host string) ([]net.IP, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestUDPResolveTimeout(t *testing.T) {
+	client := associate(t, &Server{Resolver: blockingResolver{}, DialTimeout: 100 * time.Millisecond})
+	header := UDPHeader{Atyp: DOMAINNAME, Domain: "slow.example", DstPort: 53}
+	datagram, err := SerializeUDPRequest(header, []byte("lost"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Write(datagram)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the stuck lookup gives up, and later datagrams are relayed
+	roundTripUDP(t, client, startUDPEcho(t), "ping")
+}
+
+// writeFrame sends content to conn as a UDPOverTCP frame.
+func writeFrame(t *testing.T, conn net.Conn, content []byte) {
+	t.Helper()
+	frame := make([]byte, 2, 2+len(content))
+	binary.BigEndian.PutUint16(frame, uint16(len(content)))
+	_, err := conn.Write(append(frame, content...))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUDPOverTCP(t *testing.T) {
+	echo := startUDPEcho(t)
+	conn := dialNoAuth(t, startServer(t, &Server{UDPOverTCP: true}))
+	reply := sendRequest(t, conn, UDPASSOCIATE, "0.0.0.0:0")
+	if reply.REP != Succeeded {
+		t.Fatalf("REP = %#x, want Succeeded", reply.REP)
+	}
+
+	// a frame too short for a UDP header is dropped, not fatal
+	writeFrame(t, conn, []byte{0, 0})
+	content, err := SerializeUDPRequest(newUDPHeader(echo), []byte("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFrame(t, conn, content)
+
+	length := make([]byte, 2)
+	_, err = io.ReadFull(conn, length)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame := make([]byte, binary.BigEndian.Uint16(length))
+	_, err = io.ReadFull(conn, frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, offset, err := DeserializeUDPRequest(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !header.DstAddr.Equal(echo.IP) || int(header.DstPort) != echo.Port {
+		t.Errorf("reply from %v:%d, want %v", header.DstAddr, header.DstPort, echo)
+	}
+	if got := string(frame[offset:]); got != "ping" {
+		t.Errorf("reply payload = %q, want %q", got, "ping")
+	}
+}
+
+func TestUDPOverTCPTruncatedFrame(t *testing.T) {
+	s := &Server{UDPOverTCP: true}
+	// a frame announcing 16 bytes, of which only 3 arrive
+	conn := newFakeConn([]byte{V5, 1, NoAuth}, requestBytes(t, UDPASSOCIATE, "0.0.0.0:0"), []byte{0, 16, 0, 0, 0})
+	err := s.HandleClient(conn)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("HandleClient: %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestMaxUDPDatagram(t *testing.T) {
+	echo := startUDPEcho(t)
+	client := associate(t, &Server{MaxUDPDatagram: 64})
+	roundTripUDP(t, client, echo, "ping")
+
+	// a datagram longer than the buffers is truncated to their size
+	datagram, err := SerializeUDPRequest(newUDPHeader(echo), make([]byte, 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Write(datagram)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, maxUDPDatagram)
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, offset, err := DeserializeUDPRequest(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := 64 - offset; n-offset != want {
+		t.Errorf("relayed %d payload bytes, want %d", n-offset, want)
+	}
+}
+
+func TestUDPOverTCPOversizedFrame(t *testing.T) {
+	echo := startUDPEcho(t)
+	conn := dialNoAuth(t, startServer(t, &Server{UDPOverTCP: true, MaxUDPDatagram: 64}))
+	reply := sendRequest(t, conn, UDPASSOCIATE, "0.0.0.0:0")
+	if reply.REP != Succeeded {
+		t.Fatalf("REP = %#x, want Succeeded", reply.REP)
+	}
+
+	// the oversized frame is skipped whole, and the next one is relayed
+	big, err := SerializeUDPRequest(newUDPHeader(echo), []byte(strings.Repeat("x", 100)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFrame(t, conn, big)
+	small, err := SerializeUDPRequest(newUDPHeader(echo), []byte("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFrame(t, conn, small)
+
+	length := make([]byte, 2)
+	_, err = io.ReadFull(conn, length)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame := make([]byte, binary.BigEndian.Uint16(length))
+	_, err = io.ReadFull(conn, frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, offset, err := DeserializeUDPRequest(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(frame[offset:]); got != "ping" {
+		t.Errorf("reply payload = %q, want %q", got, "ping")
+	}
+}